@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/config"
+	"github.com/tb0hdan/idun/pkg/control"
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const CtlCommand = "ctl"
+
+// ctlActions - action to HTTP method.
+var ctlActions = map[string]string{ // nolint:gochecknoglobals
+	"pause":  http.MethodPost,
+	"resume": http.MethodPost,
+	"drain":  http.MethodPost,
+	"status": http.MethodGet,
+}
+
+// RunCtl - call worker control endpoints, i.e. idun ctl -addr http://127.0.0.1:8080 drain.
+func RunCtl(args []string) {
+	fs := flag.NewFlagSet(CtlCommand, flag.ExitOnError)
+	addr := fs.String("addr", "http://127.0.0.1:8080", "Worker web server address (-webserver-port)")
+	token := fs.String("token", os.Getenv(config.EnvName("control-token")), "Control token, same as worker -control-token")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] pause|resume|drain|status\n", os.Args[0], CtlCommand)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	method, ok := ctlActions[fs.Arg(0)]
+	if fs.NArg() != 1 || !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	logger := log.New()
+
+	if !strings.HasPrefix(*addr, "http://") && !strings.HasPrefix(*addr, "https://") {
+		*addr = "http://" + *addr
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(*addr, "/")+control.PathPrefix+"/"+fs.Arg(0), nil)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	req.Header.Add("X-Session-Token", *token)
+
+	client := &http.Client{Timeout: types.ReadTimeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if _, err = io.Copy(os.Stdout, resp.Body); err != nil {
+		logger.Fatal(err)
+	}
+
+	fmt.Println()
+
+	if resp.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
@@ -3,31 +3,42 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/tb0hdan/idun/pkg/crawler/connection"
 
 	"github.com/tb0hdan/hydra"
+	"github.com/tb0hdan/idun/pkg/breaker"
 	"github.com/tb0hdan/idun/pkg/clients/agent"
 	"github.com/tb0hdan/idun/pkg/clients/apiclient"
 	"github.com/tb0hdan/idun/pkg/clients/consul"
 	"github.com/tb0hdan/idun/pkg/clients/yacy"
+	"github.com/tb0hdan/idun/pkg/config"
+	"github.com/tb0hdan/idun/pkg/control"
 	"github.com/tb0hdan/idun/pkg/crawler"
 	"github.com/tb0hdan/idun/pkg/crawler/crawlertools"
+	"github.com/tb0hdan/idun/pkg/crawler/progress"
 	"github.com/tb0hdan/idun/pkg/crawler/robots"
 	"github.com/tb0hdan/idun/pkg/crawler/worker"
+	"github.com/tb0hdan/idun/pkg/domain"
+	"github.com/tb0hdan/idun/pkg/ippolicy"
+	"github.com/tb0hdan/idun/pkg/queue"
+	"github.com/tb0hdan/idun/pkg/registry"
 	"github.com/tb0hdan/idun/pkg/servers/apiserver"
 	"github.com/tb0hdan/idun/pkg/servers/webserver"
+	"github.com/tb0hdan/idun/pkg/spool"
 	"github.com/tb0hdan/idun/pkg/types"
 	"github.com/tb0hdan/idun/pkg/utils"
-	"github.com/tb0hdan/memcache"
 )
 
 var (
@@ -38,29 +49,107 @@ var (
 	BuildDate = "unset" // nolint:gochecknoglobals
 )
 
-func RunLeader(apiBase string, c types.APIClientInterface, address string, debugMode bool,
-	srvr types.APIServerInterface, calculator types.WorkerCalculator, cache *memcache.CacheType) {
+func RunLeader(ctx context.Context, live *config.Live, c types.APIClientInterface, address string, srvr types.APIServerInterface,
+	calculator types.WorkerCalculator, limiter types.LimiterInterface, domainsQueue types.QueueInterface,
+	crawled types.RegistryInterface) {
 	workerCount, err := calculator.CalculateMaxWorkers()
 	if err != nil {
 		c.Fatal("Could not calculate worker amount")
 	}
 	c.Debugf("Will use up to %d workers", workerCount)
-	connTracker := connection.New(cache, c.GetLogger())
+
+	budget, err := calculator.MemoryBudget()
+	if err != nil {
+		c.Fatal("Could not get memory budget")
+	}
+
+	if budget > 0 {
+		c.Debugf("Memory budget is %dM, up to %dM per crawler", budget/types.OneMeg,
+			utils.MemoryPerWorker(live.Get().MemoryLimit, budget, workerCount)/types.OneMeg)
+	}
+
+	cfg := live.Get()
 	wn := worker.WorkerNode{
-		ApiBase:     apiBase,
-		ServerAddr:  address,
-		Srvr:        srvr,
-		DebugMode:   debugMode,
-		C:           c,
-		ConnTracker: connTracker,
-	}
-	pool := hydra.New(context.Background(), int(workerCount), wn, c.GetLogger())
+		Config:       live,
+		ServerAddr:   address,
+		Srvr:         srvr,
+		WorkerCount:  workerCount,
+		MemoryBudget: budget,
+		C:            c,
+		Queue:        domainsQueue,
+		Registry:     crawled,
+		Retry:        &breaker.Backoff{Min: cfg.GetDomainsRetry, Max: breaker.MaxOpenTimeout},
+		Limiter:      limiter,
+	}
+	pool := hydra.New(ctx, int(workerCount), wn, c.GetLogger())
 	pool.Run()
 }
 
+// ApplyKV - overlay Consul KV options on base config and publish result.
+// Crawler options apply to next crawl, worker ones (i.e. overcommit) on restart.
+func ApplyKV(base *config.Config, live *config.Live, values map[string]string, logger *log.Logger) {
+	previous := live.Get()
+	cfg := base.Clone()
+
+	for option, raw := range values {
+		if err := cfg.Apply(option, raw); err != nil {
+			logger.Errorf("Consul KV %s%s: %+v", consul.KVPrefix, option, err)
+		}
+	}
+
+	if _, err := domain.ParseScopePolicy(cfg.Scope); err != nil {
+		logger.Errorf("Consul KV %sscope: %+v", consul.KVPrefix, err)
+		cfg.Scope = previous.Scope
+	}
+
+	ipPolicy, err := ippolicy.Load(cfg.BannedCIDRsFile, cfg.BannedCIDRs)
+	if err != nil {
+		logger.Errorf("Consul KV banned networks: %+v", err)
+		cfg.BannedCIDRsFile, cfg.BannedCIDRs = previous.BannedCIDRsFile, previous.BannedCIDRs
+	} else {
+		ippolicy.Default.Replace(ipPolicy)
+	}
+
+	domain.SetDefault(&domain.Normalizer{StripWWW: cfg.StripWWW})
+	live.Set(cfg)
+	logger.Printf("Applied %d option(s) from Consul KV", len(values))
+}
+
+// ReplayFilter - send spooled batch to API and queue domains that passed.
+func ReplayFilter(cfg *config.Config, c types.APIClientInterface, ua string,
+	domainsQueue types.QueueInterface) func(domains []string) error {
+	return func(domains []string) error {
+		outgoing, err := c.FilterDomains(domains)
+		if err != nil {
+			return err
+		}
+
+		for host := range utils.HeadCheckDomains(outgoing, ua, cfg.HeadCheckTimeout) {
+			if err := domainsQueue.Push(host, 0); err != nil {
+				c.Debugf("Could not queue %s: %+v", host, err)
+			}
+		}
+
+		return nil
+	}
+}
+
 func main() { // nolint:funlen
-	apiBase := flag.String("apiBase", types.APIBase, "API server base URL")
-	debugMode := flag.Bool("debug", false, "Enable colly/crawler debugging")
+	// crawler subprocess starts once worker has set its limits
+	crawlertools.WaitStart()
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == ServeAPICommand {
+		RunServeAPI(os.Args[2:])
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == CtlCommand {
+		RunCtl(os.Args[2:])
+
+		return
+	}
+
 	targetURL := flag.String("url", "", "URL/Domain to crawl")
 	serverAddr := flag.String("servers", "", "Local supervisor address")
 	domainsFile := flag.String("file", "", "Domains file, one domain per line")
@@ -75,9 +164,7 @@ func main() { // nolint:funlen
 	customDomainsURL := flag.String("custom-domains-url", "", "Get domains from custom URL")
 	version := flag.Bool("version", false, "Print version and exit")
 	//
-	overcommitRatio := flag.Int64("overcommit", 1, "Over commit ratio for workers")
-	domainsCacheExpires := flag.Int64("domains-expires", 86400, "Expiration in seconds for local domains cache")
-	//
+	loader := config.NewLoader(flag.CommandLine)
 	flag.Parse()
 
 	logger := log.New()
@@ -90,14 +177,32 @@ func main() { // nolint:funlen
 		fmt.Println(Version, GoVersion, Build, BuildDate)
 		return
 	}
-	if *debugMode {
+	cfg, err := loader.Load()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if cfg.Debug {
 		logger.SetLevel(log.DebugLevel)
 	}
+
+	domain.SetDefault(&domain.Normalizer{StripWWW: cfg.StripWWW})
+
+	if _, err = domain.ParseScopePolicy(cfg.Scope); err != nil {
+		logger.Fatal(err)
+	}
+
+	ipPolicy, err := ippolicy.Load(cfg.BannedCIDRsFile, cfg.BannedCIDRs)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	ippolicy.Default.Replace(ipPolicy)
 	// configure idunClient
 	client := &apiclient.Client{
 		Key:              types.FreyaKey,
 		Logger:           logger,
-		APIBase:          *apiBase,
+		APIBase:          cfg.APIBase,
 		CustomDomainsURL: *customDomainsURL,
 	}
 	// both agentMode mode and workers use this
@@ -108,7 +213,7 @@ func main() { // nolint:funlen
 
 	if *agentMode && len(consulURL) > 0 {
 		logger.Println("Starting in agentMode mode. Please use only one per host.")
-		agent.RunAgent(consulURL, logger, *agentPort, Version, GoVersion, Build, BuildDate)
+		agent.RunAgent(cfg, consulURL, logger, *agentPort, Version, GoVersion, Build, BuildDate)
 
 		return
 	}
@@ -117,13 +222,22 @@ func main() { // nolint:funlen
 	if len(*targetURL) != 0 && len(*serverAddr) != 0 {
 		log.Println("Starting crawl of ", *targetURL)
 
-		// FIXME: Find common place for URL normalization
-		if !strings.HasPrefix(*targetURL, "http://") && !strings.HasPrefix(*targetURL, "https://") {
-			*targetURL = "http://" + *targetURL
-		}
+		*targetURL = domain.ToURL(*targetURL)
 
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+		defer stop()
+
+		// progress goes to worker over inherited pipe
+		reporter := progress.FromEnv()
+		crawlertools.ExitOnCPULimit(reporter)
 		robo := robots.NewRoboTester(*targetURL)
-		crawler.CrawlURL(client, *targetURL, *debugMode, *serverAddr, robo)
+		err := crawler.CrawlURL(ctx, cfg, client, *targetURL, *serverAddr, robo, reporter)
+
+		if err != nil {
+			log.Error(err)
+		}
+
+		reporter.Exit(crawler.ExitReason(err), err)
 
 		return
 	}
@@ -133,12 +247,26 @@ func main() { // nolint:funlen
 		panic(err)
 	}
 
-	cache := memcache.New(logger)
-	s := apiserver.NewAPIServer(cache, ua, *domainsCacheExpires)
+	limits, err := connection.ParseLimits(cfg.IPLimits)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	tracker := connection.New(limits)
+
+	domainsQueue, err := queue.New(cfg.DataDir, cfg.DomainsExpires, cfg.QueueMaxSize, logger)
+	if err != nil {
+		panic(err)
+	}
+
+	defer domainsQueue.Close()
+
+	s := apiserver.NewAPIServer(domainsQueue, ua)
 
 	r := mux.NewRouter()
 	r.HandleFunc("/upload", s.UploadDomains).Methods(http.MethodPost)
 	r.HandleFunc("/ua", s.UA).Methods(http.MethodGet)
+	r.HandleFunc(connection.LimitPath, tracker.Handler).Methods(http.MethodGet)
 
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -151,15 +279,15 @@ func main() { // nolint:funlen
 	httpServer := &http.Server{
 		Addr:         Address,
 		Handler:      r,
-		ReadTimeout:  types.ReadTimeout,
-		WriteTimeout: types.WriteTimeout,
-		IdleTimeout:  types.IdleTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
 	}
 
 	go func() {
 		log.Println("Starting internal listener at ", Address)
 
-		if err := httpServer.ListenAndServe(); err != nil {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			panic(err)
 		}
 	}()
@@ -167,14 +295,14 @@ func main() { // nolint:funlen
 	// start listener for this one and below
 	if *yacyMode {
 		log.Println("Starting Yacy.net mode")
-		yacy.CrawlYacyHosts(*apiBase, *yacyAddr, Address, *debugMode, s)
+		yacy.CrawlYacyHosts(cfg, *yacyAddr, Address, s)
 
 		return
 	}
 
 	if *single {
 		log.Println("Starting single URL mode")
-		crawlertools.RunCrawl(*apiBase, *targetURL, Address, *debugMode)
+		crawlertools.RunCrawl(cfg, *targetURL, Address, nil)
 
 		return
 	}
@@ -182,22 +310,97 @@ func main() { // nolint:funlen
 	if len(*domainsFile) == 0 {
 		log.Println("Starting normal mode")
 		//
-		ws := webserver.NewWebServer(fmt.Sprintf(":%d", *webserverPort), types.ReadTimeout, types.WriteTimeout, types.IdleTimeout)
+		live := config.NewLive(cfg)
+		//
+		ws := webserver.NewWebServer(fmt.Sprintf(":%d", *webserverPort), cfg)
 		ws.SetBuildInfo(Version, GoVersion, Build, BuildDate)
+		ws.Handle(control.PathPrefix, control.Handler(control.Default, func() string {
+			return live.Get().ControlToken
+		}))
+		// bind now, Consul check needs actual port
+		if err := ws.Listen(); err != nil {
+			logger.Fatal(err)
+		}
 
 		go ws.Run()
-		//
+
+		var (
+			consulClient *consul.Client
+			kvIndex      uint64
+		)
+
 		if len(consulURL) != 0 {
 			// We have consulClient. Register there
-			consulClient := consul.NewConsul(consulURL, logger)
+			consulClient = consul.NewConsul(consulURL, logger)
+			consulClient.SetAdvertisedPort(ws.Port())
+			//
+			values, index, err := consulClient.GetKV(context.Background(), consul.KVPrefix, 0)
+			if err != nil {
+				logger.Errorf("Could not read Consul KV: %+v", err)
+			} else {
+				kvIndex = index
+				ApplyKV(cfg, live, values, logger)
+			}
+			//
 			consulClient.Register()
 			//
 			defer consulClient.Deregister()
 		}
 		//
-		calculator := &utils.Calculator{OvercommitRatio: *overcommitRatio}
-		RunLeader(*apiBase, client, Address, *debugMode, s, calculator, cache)
+		unsent, err := spool.New(cfg.DataDir, cfg.SpoolMaxBytes, logger)
+		if err != nil {
+			panic(err)
+		}
+
+		// stop on signal or once drain is complete
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+		defer stop()
 
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go func() {
+			<-control.Default.Drained()
+			log.Println("Drain completed, exiting")
+			cancel()
+		}()
+
+		if consulClient != nil {
+			go consulClient.WatchKV(ctx, consul.KVPrefix, kvIndex, func(values map[string]string) {
+				ApplyKV(cfg, live, values, logger)
+			})
+		}
+
+		// consulClient is typed nil otherwise
+		var consulRegistry types.RegistryInterface
+		if consulClient != nil {
+			consulRegistry = consulClient
+		}
+
+		crawled, err := registry.New(live.Get().Registry, live.Get().RegistryDir, consulRegistry)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		//
+		go unsent.Run(ctx, cfg.CrawlFilterRetry, ReplayFilter(live.Get(), client, ua, domainsQueue))
+		//
+		calculator := &utils.Calculator{Config: live.Get()}
+		RunLeader(ctx, live, client, Address, s, calculator, tracker, domainsQueue, crawled)
+		// second signal terminates immediately
+		stop()
+		log.Printf("Shutting down, waiting up to %s for running crawls", live.Get().ShutdownGrace)
+
+		if !control.Default.Shutdown(live.Get().ShutdownGrace) {
+			log.Println("Grace period exceeded, remaining crawls were killed")
+		}
+		// crawlers submit discovered domains on exit, let those uploads finish
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.WriteTimeout)
+		defer cancelShutdown()
+
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Error(err)
+		}
+		// deferred: Consul deregistration, queue journal flush (it is compacted on next start)
 		return
 	}
 	//
@@ -212,7 +415,14 @@ func main() { // nolint:funlen
 
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		crawlertools.RunCrawl(*apiBase, scanner.Text(), Address, *debugMode)
+		seed, err := domain.Seed(scanner.Text())
+		if err != nil {
+			log.Debugf("Skipping %s: %+v", scanner.Text(), err)
+
+			continue
+		}
+
+		crawlertools.RunCrawl(cfg, seed, Address, nil)
 
 		// time to empty out cache
 		for {
@@ -221,7 +431,7 @@ func main() { // nolint:funlen
 				break
 			}
 
-			crawlertools.RunCrawl(*apiBase, domain, Address, *debugMode)
+			crawlertools.RunCrawl(cfg, domain, Address, nil)
 		}
 	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/config"
+	"github.com/tb0hdan/idun/pkg/servers/mockapi"
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const (
+	ServeAPICommand = "serve-api"
+	DefaultMockUA   = "Mozilla/5.0 (compatible; idun; +https://github.com/tb0hdan/idun)"
+)
+
+// RunServeAPI - self-hosted Domains Project API implementation. Use with -apiBase http://addr/api/vo.
+func RunServeAPI(args []string) {
+	fs := flag.NewFlagSet(ServeAPICommand, flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "Listen address")
+	basePath := fs.String("base", "/api/vo", "API base path")
+	seedFile := fs.String("seed", "", "Seed domains file, one domain per line")
+	outFile := fs.String("out", "discovered.txt", "Discovered domains file, also used for deduplication")
+	servedFile := fs.String("served", "served.txt", "Domains already handed out by /domains, not served again after restart")
+	resultsFile := fs.String("results", "results.jsonl", "Crawl results file, one JSON object per line")
+	userAgent := fs.String("ua", DefaultMockUA, "User agent handed out to workers")
+	token := fs.String("token", types.FreyaKey, "Required X-Session-Token, empty disables check")
+	batchSize := fs.Int("batch", mockapi.DefaultBatchSize, "Domains per /domains response")
+	_ = fs.Parse(args)
+
+	logger := log.New()
+
+	store, err := mockapi.NewStore(*seedFile, *outFile, *servedFile, *resultsFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	defer store.Close()
+
+	cfg := config.Default()
+	srv := &http.Server{
+		Addr:         *listen,
+		Handler:      mockapi.NewServer(store, *userAgent, *token, *batchSize).Router(*basePath),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		_ = srv.Close()
+	}()
+
+	logger.Printf("Serving API at http://%s%s", *listen, *basePath)
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(err)
+	}
+}
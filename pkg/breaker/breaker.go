@@ -0,0 +1,237 @@
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	FailureThreshold = 5
+	MinOpenTimeout   = 10 * time.Second
+	MaxOpenTimeout   = 10 * time.Minute
+)
+
+var (
+	ErrOpen = errors.New("circuit breaker is open") // nolint:gochecknoglobals
+	// Default - per-process registry, exposed on /health.
+	Default = NewRegistry() // nolint:gochecknoglobals
+)
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+type Status struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	RetryAt   time.Time `json:"retry_at,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Breaker - closed: requests pass, open after FailureThreshold consecutive failures.
+// Open: requests fail fast until timeout, then one probe is let through (half-open).
+// Probe success closes breaker, failure opens it again for twice as long.
+type Breaker struct {
+	name      string
+	lock      sync.Mutex
+	state     State
+	failures  int
+	trips     int
+	retryAt   time.Time
+	probing   bool
+	lastError string
+}
+
+// Allow - check whether request may be sent. ErrOpen wraps time of next attempt.
+func (b *Breaker) Allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case Closed:
+		return nil
+	case Open:
+		if time.Now().Before(b.retryAt) {
+			return fmt.Errorf("%w: %s, retry in %s", ErrOpen, b.name, time.Until(b.retryAt).Round(time.Second))
+		}
+
+		b.state = HalfOpen
+		b.probing = true
+
+		return nil
+	case HalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w: %s, probe in flight", ErrOpen, b.name)
+		}
+
+		b.probing = true
+	}
+
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = Closed
+	b.failures = 0
+	b.trips = 0
+	b.probing = false
+	b.lastError = ""
+}
+
+// Failure - record failure, delay overrides computed open timeout (i.e. from Retry-After).
+func (b *Breaker) Failure(err error, delay time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if err != nil {
+		b.lastError = err.Error()
+	}
+
+	if b.state != HalfOpen && b.failures < FailureThreshold && delay == 0 {
+		return
+	}
+
+	if delay == 0 {
+		delay = Exponential(MinOpenTimeout, MaxOpenTimeout, b.trips)
+	}
+
+	b.trips++
+	b.state = Open
+	b.retryAt = time.Now().Add(delay)
+}
+
+// RetryAt - time when open breaker lets next probe through.
+func (b *Breaker) RetryAt() time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.retryAt
+}
+
+func (b *Breaker) Status() Status {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	status := Status{
+		Name:      b.name,
+		State:     b.state.String(),
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+
+	if b.state != Closed {
+		status.RetryAt = b.retryAt
+	}
+
+	return status
+}
+
+type Registry struct {
+	lock     sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func (r *Registry) Get(name string) *Breaker {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, ok := r.breakers[name]
+	if !ok {
+		b = &Breaker{name: name}
+		r.breakers[name] = b
+	}
+
+	return b
+}
+
+func (r *Registry) Statuses() []Status {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.breakers))
+
+	for name := range r.breakers {
+		names = append(names, name)
+	}
+	r.lock.Unlock()
+
+	sort.Strings(names)
+
+	statuses := make([]Status, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, r.Get(name).Status())
+	}
+
+	return statuses
+}
+
+func NewRegistry() *Registry {
+	return &Registry{breakers: make(map[string]*Breaker)}
+}
+
+// Exponential - min * 2^attempt capped at max, with full jitter in upper half to spread clients apart.
+func Exponential(min, max time.Duration, attempt int) time.Duration {
+	delay := max
+
+	if attempt < 32 {
+		if scaled := min << uint(attempt); scaled > 0 && scaled < max {
+			delay = scaled
+		}
+	}
+
+	half := delay / 2
+
+	return half + time.Duration(rand.Int63n(int64(half)+1)) // nolint:gosec
+}
+
+// Backoff - consecutive failure counter for retry loops.
+type Backoff struct {
+	Min      time.Duration
+	Max      time.Duration
+	lock     sync.Mutex
+	attempts int
+}
+
+// Next - delay before next attempt, grows with every call until Reset.
+func (b *Backoff) Next() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delay := Exponential(b.Min, b.Max, b.attempts)
+	b.attempts++
+
+	return delay
+}
+
+func (b *Backoff) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.attempts = 0
+}
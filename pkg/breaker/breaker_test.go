@@ -0,0 +1,95 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("test failure") // nolint:gochecknoglobals
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		delay    time.Duration
+		state    State
+	}{
+		{"below threshold", FailureThreshold - 1, 0, Closed},
+		{"threshold", FailureThreshold, 0, Open},
+		{"retry-after opens right away", 1, time.Minute, Open},
+	}
+
+	for _, tt := range tests {
+		b := NewRegistry().Get(tt.name)
+
+		for i := 0; i < tt.failures; i++ {
+			b.Failure(errTest, tt.delay)
+		}
+
+		if b.state != tt.state {
+			t.Errorf("%s: state %s, want %s", tt.name, b.state, tt.state)
+		}
+
+		if err := b.Allow(); errors.Is(err, ErrOpen) != (tt.state == Open) {
+			t.Errorf("%s: Allow() = %v", tt.name, err)
+		}
+
+		if tt.delay > 0 && time.Until(b.RetryAt()) > tt.delay {
+			t.Errorf("%s: retry at %s, delay %s", tt.name, b.RetryAt(), tt.delay)
+		}
+	}
+}
+
+func TestHalfOpen(t *testing.T) {
+	b := NewRegistry().Get("probe")
+	b.Failure(errTest, time.Minute)
+	// timeout passed
+	b.retryAt = time.Now().Add(-time.Second)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe not allowed: %v", err)
+	}
+
+	if err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("second request during probe allowed: %v", err)
+	}
+
+	b.Failure(errTest, 0)
+
+	if b.state != Open || b.trips != 2 {
+		t.Fatalf("failed probe: state %s, trips %d", b.state, b.trips)
+	}
+
+	b.retryAt = time.Now().Add(-time.Second)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe not allowed: %v", err)
+	}
+
+	b.Success()
+
+	if status := b.Status(); status.State != "closed" || status.Failures != 0 || !status.RetryAt.IsZero() {
+		t.Errorf("after successful probe: %+v", status)
+	}
+}
+
+func TestExponential(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 5 * time.Second, 10 * time.Second},
+		{2, 20 * time.Second, 40 * time.Second},
+		{10, 50 * time.Second, 100 * time.Second},
+		{100, 50 * time.Second, 100 * time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := Exponential(10*time.Second, 100*time.Second, tt.attempt); delay < tt.min || delay > tt.max {
+				t.Fatalf("Exponential(attempt %d) = %s, want %s..%s", tt.attempt, delay, tt.min, tt.max)
+			}
+		}
+	}
+}
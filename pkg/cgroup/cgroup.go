@@ -0,0 +1,232 @@
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	Root     = "/sys/fs/cgroup"
+	SelfFile = "/proc/self/cgroup"
+	// cgroup versions.
+	None = 0
+	V1   = 1
+	V2   = 2
+	// unlimitedV1 - v1 reports no memory limit as page-rounded max int64.
+	unlimitedV1 = uint64(1) << 62
+)
+
+// Limits - resource limits of cgroup current process belongs to. Zero limit means unlimited.
+type Limits struct {
+	Version int
+	// Path - cgroup directory, memory controller one for v1
+	Path string
+	// MemoryMax - memory limit in bytes
+	MemoryMax uint64
+	// MemoryUsed - memory in use by cgroup in bytes, reclaimable page cache excluded
+	MemoryUsed uint64
+	// CPUs - CPU quota in CPUs, i.e. 1.5
+	CPUs float64
+}
+
+// IsV2 - whether unified hierarchy is mounted at Root.
+func IsV2() bool {
+	_, err := os.Stat(filepath.Join(Root, "cgroup.controllers"))
+
+	return err == nil
+}
+
+// paths - controller to cgroup path from /proc/self/cgroup. Unified hierarchy has empty controller.
+func paths() (map[string]string, error) {
+	data, err := os.ReadFile(SelfFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			result[controller] = fields[2]
+		}
+	}
+
+	return result, nil
+}
+
+// dir - cgroup directory under mount, mount itself when cgroup namespace hides the path.
+func dir(mount, path string) string {
+	full := filepath.Join(mount, path)
+	if _, err := os.Stat(full); err == nil {
+		return full
+	}
+
+	return mount
+}
+
+func readString(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+
+	return strings.TrimSpace(string(data)), true
+}
+
+func readUint(path string) (uint64, bool) {
+	value, ok := readString(path)
+	if !ok {
+		return 0, false
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return parsed, true
+}
+
+func readFloat(path string) (float64, bool) {
+	value, ok := readString(path)
+	if !ok {
+		return 0, false
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return parsed, true
+}
+
+// statValue - key value from memory.stat.
+func statValue(path, key string) uint64 {
+	data, ok := readString(path)
+	if !ok {
+		return 0
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		name, value, found := strings.Cut(line, " ")
+		if found && name == key {
+			parsed, _ := strconv.ParseUint(value, 10, 64)
+
+			return parsed
+		}
+	}
+
+	return 0
+}
+
+// used - usage minus inactive page cache, same as docker stats.
+func used(usage, inactive uint64) uint64 {
+	if inactive > usage {
+		return 0
+	}
+
+	return usage - inactive
+}
+
+// minLimit - smaller of non-zero limits.
+func minLimit(current, limit uint64) uint64 {
+	if current == 0 || (limit > 0 && limit < current) {
+		return limit
+	}
+
+	return current
+}
+
+func readV2(path string) Limits {
+	limits := Limits{Version: V2, Path: dir(Root, path)}
+	// limits of ancestors apply too
+	for current := limits.Path; strings.HasPrefix(current, Root); current = filepath.Dir(current) {
+		if value, ok := readString(filepath.Join(current, "memory.max")); ok && value != "max" {
+			if parsed, err := strconv.ParseUint(value, 10, 64); err == nil {
+				limits.MemoryMax = minLimit(limits.MemoryMax, parsed)
+			}
+		}
+
+		if value, ok := readString(filepath.Join(current, "cpu.max")); ok {
+			quota, period, _ := strings.Cut(value, " ")
+			q, err1 := strconv.ParseFloat(quota, 64)
+			p, err2 := strconv.ParseFloat(period, 64)
+
+			if err1 == nil && err2 == nil && p > 0 && (limits.CPUs == 0 || q/p < limits.CPUs) {
+				limits.CPUs = q / p
+			}
+		}
+
+		if current == Root {
+			break
+		}
+	}
+
+	usage, _ := readUint(filepath.Join(limits.Path, "memory.current"))
+	limits.MemoryUsed = used(usage, statValue(filepath.Join(limits.Path, "memory.stat"), "inactive_file"))
+
+	return limits
+}
+
+func readV1(controllers map[string]string) Limits {
+	limits := Limits{Version: V1}
+
+	if path, ok := controllers["memory"]; ok {
+		limits.Path = dir(filepath.Join(Root, "memory"), path)
+
+		if limit, ok := readUint(filepath.Join(limits.Path, "memory.limit_in_bytes")); ok && limit < unlimitedV1 {
+			limits.MemoryMax = limit
+		}
+
+		usage, _ := readUint(filepath.Join(limits.Path, "memory.usage_in_bytes"))
+		limits.MemoryUsed = used(usage, statValue(filepath.Join(limits.Path, "memory.stat"), "total_inactive_file"))
+	}
+
+	if path, ok := controllers["cpu"]; ok {
+		// cpu is often co-mounted with cpuacct
+		mount := filepath.Join(Root, "cpu")
+		if _, err := os.Stat(mount); err != nil {
+			mount = filepath.Join(Root, "cpu,cpuacct")
+		}
+
+		cpuDir := dir(mount, path)
+		quota, ok1 := readFloat(filepath.Join(cpuDir, "cpu.cfs_quota_us"))
+		period, ok2 := readFloat(filepath.Join(cpuDir, "cpu.cfs_period_us"))
+
+		// quota is -1 when unlimited
+		if ok1 && ok2 && quota > 0 && period > 0 {
+			limits.CPUs = quota / period
+		}
+	}
+
+	return limits
+}
+
+// Read - limits of current process cgroup, Version is None when cgroups aren't available.
+func Read() (Limits, error) {
+	controllers, err := paths()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Limits{}, nil
+		}
+
+		return Limits{}, err
+	}
+
+	if IsV2() {
+		return readV2(controllers[""]), nil
+	}
+
+	return readV1(controllers), nil
+}
@@ -0,0 +1,154 @@
+package cgroup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// LeaderGroup - leaf group processes of delegated cgroup are moved to,
+	// cgroup v2 doesn't enable controllers for children of a group with processes.
+	LeaderGroup = "leader"
+	childPrefix = "crawler-"
+)
+
+var ErrNotDelegated = errors.New("cgroup v2 with memory and pids controllers is not delegated") // nolint:gochecknoglobals
+
+// nolint:gochecknoglobals
+var delegated struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+func write(path, value string) error {
+	return os.WriteFile(path, []byte(value), 0o644) // nolint:gosec
+}
+
+func enable(dir string) error {
+	return write(filepath.Join(dir, "cgroup.subtree_control"), "+memory +pids")
+}
+
+func delegate() (string, error) {
+	if !IsV2() {
+		return "", ErrNotDelegated
+	}
+
+	controllers, err := paths()
+	if err != nil {
+		return "", err
+	}
+
+	own := dir(Root, controllers[""])
+
+	available, _ := readString(filepath.Join(own, "cgroup.controllers"))
+	fields := strings.Fields(available)
+
+	if !contains(fields, "memory") || !contains(fields, "pids") {
+		return "", ErrNotDelegated
+	}
+
+	if err = enable(own); err == nil {
+		return own, nil
+	}
+
+	// move own processes to leaf group and retry
+	leader := filepath.Join(own, LeaderGroup)
+	if err = os.Mkdir(leader, 0o755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	procs, _ := readString(filepath.Join(own, "cgroup.procs"))
+	for _, pid := range strings.Fields(procs) {
+		// processes may exit meanwhile
+		_ = write(filepath.Join(leader, "cgroup.procs"), pid)
+	}
+
+	if err = enable(own); err != nil {
+		return "", err
+	}
+
+	return own, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Delegate - prepare own cgroup for per-crawler groups, done once per process.
+// Returns ErrNotDelegated when cgroup v2 controllers aren't available to this process.
+func Delegate() (string, error) {
+	delegated.once.Do(func() {
+		delegated.dir, delegated.err = delegate()
+	})
+
+	return delegated.dir, delegated.err
+}
+
+// Child - cgroup of one crawler subprocess. Nil Child is a valid no-op.
+type Child struct {
+	dir string
+}
+
+// Add - move process to group.
+func (c *Child) Add(pid int) error {
+	if c == nil {
+		return nil
+	}
+
+	return write(filepath.Join(c.dir, "cgroup.procs"), strconv.Itoa(pid))
+}
+
+// OOMKilled - whether kernel OOM killer killed processes of the group.
+func (c *Child) OOMKilled() bool {
+	if c == nil {
+		return false
+	}
+
+	return statValue(filepath.Join(c.dir, "memory.events"), "oom_kill") > 0
+}
+
+// Remove - delete group, it has to have no processes left.
+func (c *Child) Remove() error {
+	if c == nil {
+		return nil
+	}
+
+	return os.Remove(c.dir)
+}
+
+// NewChild - group under delegated cgroup with memory and process count limits, swap disabled.
+func NewChild(name string, memoryMax, pidsMax uint64) (*Child, error) {
+	parent, err := Delegate()
+	if err != nil {
+		return nil, err
+	}
+
+	child := &Child{dir: filepath.Join(parent, childPrefix+name)}
+	if err = os.Mkdir(child.dir, 0o755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	limits := map[string]uint64{"memory.max": memoryMax, "pids.max": pidsMax}
+	for file, value := range limits {
+		if err = write(filepath.Join(child.dir, file), strconv.FormatUint(value, 10)); err != nil {
+			_ = child.Remove()
+
+			return nil, err
+		}
+	}
+	// missing without swap accounting
+	_ = write(filepath.Join(child.dir, "memory.swap.max"), "0")
+
+	return child, nil
+}
@@ -1,24 +1,40 @@
 package agent
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/tb0hdan/idun/pkg/clients/consul"
+	"github.com/tb0hdan/idun/pkg/config"
 	"github.com/tb0hdan/idun/pkg/servers/webserver"
-	"github.com/tb0hdan/idun/pkg/types"
 )
 
-func RunAgent(consulURL string, logger *log.Logger, agentPort int, Version, GoVersion, Build, BuildDate string) {
-	ws := webserver.NewWebServer(fmt.Sprintf(":%d", agentPort), types.ReadTimeout, types.WriteTimeout, types.IdleTimeout)
+// RunAgent - serve /health for Consul check until interrupted.
+func RunAgent(cfg *config.Config, consulURL string, logger *log.Logger, agentPort int, Version, GoVersion, Build, BuildDate string) {
+	ws := webserver.NewWebServer(fmt.Sprintf(":%d", agentPort), cfg)
 	ws.SetBuildInfo(Version, GoVersion, Build, BuildDate)
 
+	if err := ws.Listen(); err != nil {
+		logger.Fatal(err)
+	}
+
 	go ws.Run()
 	//
 	// We have consulClient. Register there
 	consulClient := consul.NewConsul(consulURL, logger)
 	consulClient.SetServiceName("agent")
-	consulClient.SetAdvertisedPort(agentPort)
+	consulClient.SetAdvertisedPort(ws.Port())
 	consulClient.Register()
+
+	defer consulClient.Deregister()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	<-ctx.Done()
 }
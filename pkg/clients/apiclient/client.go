@@ -5,16 +5,26 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-retryablehttp"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/tb0hdan/idun/pkg/metrics"
 	"github.com/tb0hdan/idun/pkg/types"
 	"github.com/tb0hdan/idun/pkg/utils"
 )
 
+var (
+	ErrBadStatus = errors.New("bad response status") // nolint:gochecknoglobals
+	// ErrNotSupported - API server has no /result endpoint.
+	ErrNotSupported = errors.New("not supported by API server") // nolint:gochecknoglobals
+)
+
 func PrepareClient(logger *log.Logger) *retryablehttp.Client {
 	retryClient := retryablehttp.NewClient()
 	// DefaultClient uses DefaultTransport which in turn has idle connections and keepalives disabled.
@@ -25,11 +35,16 @@ func PrepareClient(logger *log.Logger) *retryablehttp.Client {
 	return retryClient
 }
 
+// ResultRecheck - /result isn't called for this long after server reported it doesn't support it.
+const ResultRecheck = time.Hour
+
 type Client struct {
-	APIBase          string
-	Key              string
-	Logger           *log.Logger
-	CustomDomainsURL string
+	// resultUnsupportedUntil - unix nanoseconds, first for 64-bit alignment of atomic access
+	resultUnsupportedUntil int64
+	APIBase                string
+	Key                    string
+	Logger                 *log.Logger
+	CustomDomainsURL       string
 }
 
 func (c *Client) Fatal(args ...interface{}) {
@@ -56,8 +71,7 @@ func (c *Client) GetUA(uaURL string) (string, error) {
 	//
 	req.Header.Add("X-Session-Token", c.Key)
 	//
-	retryClient := PrepareClient(c.Logger)
-	resp, err := retryClient.Do(req)
+	resp, err := c.do(req)
 	//
 	if err != nil {
 		return "", err
@@ -93,8 +107,7 @@ func (c *Client) GetDomains() ([]string, error) {
 	//
 	req.Header.Add("X-Session-Token", c.Key)
 	//
-	retryClient := PrepareClient(c.Logger)
-	resp, err := retryClient.Do(req)
+	resp, err := c.do(req)
 	//
 	if err != nil {
 		return nil, err
@@ -130,6 +143,9 @@ func (c *Client) FilterDomains(incoming []string) (outgoing []string, err error)
 
 	log.Println("Filter called: ", incoming)
 
+	started := time.Now()
+	defer func() { metrics.ObserveFilter(started, err) }()
+
 	data, err := json.Marshal(&domainsRequest)
 	if err != nil {
 		return nil, err
@@ -153,8 +169,7 @@ func (c *Client) FilterDomains(incoming []string) (outgoing []string, err error)
 	req.Header.Add("X-Session-Token", c.Key)
 	req.Header.Add("Content-Encoding", "gzip")
 	//
-	retryClient := PrepareClient(c.Logger)
-	resp, err := retryClient.Do(req)
+	resp, err := c.do(req)
 	//
 	if err != nil {
 		return nil, err
@@ -172,3 +187,42 @@ func (c *Client) FilterDomains(incoming []string) (outgoing []string, err error)
 
 	return outgoing, nil
 }
+
+// ReportResult - send crawl summary of one domain. ErrNotSupported is cached for ResultRecheck.
+func (c *Client) ReportResult(result *types.CrawlResult) error {
+	if time.Now().UnixNano() < atomic.LoadInt64(&c.resultUnsupportedUntil) {
+		return ErrNotSupported
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	req, err := retryablehttp.NewRequest(http.MethodPost, c.APIBase+"/result", data)
+	//
+	if err != nil {
+		return err
+	}
+	//
+	req.Header.Add("X-Session-Token", c.Key)
+	req.Header.Add("Content-Type", "application/json")
+	//
+	resp, err := c.do(req)
+	//
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		atomic.StoreInt64(&c.resultUnsupportedUntil, time.Now().Add(ResultRecheck).UnixNano())
+
+		return fmt.Errorf("%w: %s", ErrNotSupported, req.URL)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return fmt.Errorf("%w: %s %s", ErrBadStatus, req.URL, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package apiclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-retryablehttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/breaker"
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const (
+	RetryWaitMin = time.Second
+	RetryWaitMax = 30 * time.Second
+	// MaxRetryAfter - cap for server supplied Retry-After.
+	MaxRetryAfter = breaker.MaxOpenTimeout
+	// MaxRetryAfterSleep - longer Retry-After isn't waited for in client, response goes to circuit breaker instead.
+	MaxRetryAfterSleep = 5 * time.Second
+)
+
+var (
+	sharedOnce   sync.Once             // nolint:gochecknoglobals
+	sharedClient *retryablehttp.Client // nolint:gochecknoglobals
+)
+
+// RetryAfter - parse Retry-After (seconds or HTTP date) of 429 and 503 responses.
+func RetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	var delay time.Duration
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+
+	if delay > MaxRetryAfter {
+		delay = MaxRetryAfter
+	}
+
+	return delay, true
+}
+
+// CheckRetry - retryablehttp default policy, except for Retry-After longer than MaxRetryAfterSleep.
+// Callers shouldn't be blocked that long, circuit breaker keeps endpoint closed meanwhile.
+func CheckRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if delay, ok := RetryAfter(resp); ok && delay > MaxRetryAfterSleep {
+		return false, nil
+	}
+
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// Backoff - honour short Retry-After, otherwise jittered exponential backoff.
+func Backoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if delay, ok := RetryAfter(resp); ok {
+		return delay
+	}
+
+	return breaker.Exponential(min, max, attemptNum)
+}
+
+// Shared - single pooled Domains API client per process, connections are reused between calls.
+func Shared(logger *log.Logger) *retryablehttp.Client {
+	sharedOnce.Do(func() {
+		sharedClient = retryablehttp.NewClient()
+		sharedClient.HTTPClient = cleanhttp.DefaultPooledClient()
+		sharedClient.RetryMax = types.APIRetryMax
+		sharedClient.RetryWaitMin = RetryWaitMin
+		sharedClient.RetryWaitMax = RetryWaitMax
+		sharedClient.Backoff = Backoff
+		sharedClient.CheckRetry = CheckRetry
+		// return last response so Retry-After reaches circuit breaker
+		sharedClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
+		sharedClient.Logger = logger
+	})
+
+	return sharedClient
+}
+
+// do - send request through shared client guarded by per-endpoint circuit breaker.
+func (c *Client) do(req *retryablehttp.Request) (*http.Response, error) {
+	endpoint := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	br := breaker.Default.Get(endpoint)
+
+	if err := br.Allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := Shared(c.Logger).Do(req)
+	if err != nil {
+		br.Failure(err, 0)
+
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		delay, _ := RetryAfter(resp)
+		resp.Body.Close()
+
+		err = fmt.Errorf("%w: %s %s", ErrBadStatus, endpoint, resp.Status)
+		br.Failure(err, delay)
+
+		return nil, err
+	}
+
+	br.Success()
+
+	return resp, nil
+}
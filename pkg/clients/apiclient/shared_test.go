@@ -0,0 +1,75 @@
+package apiclient
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func response(status int, retryAfter string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+	if len(retryAfter) > 0 {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+
+	return resp
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		resp  *http.Response
+		delay time.Duration
+		ok    bool
+	}{
+		{"no response", nil, 0, false},
+		{"seconds", response(http.StatusTooManyRequests, "7"), 7 * time.Second, true},
+		{"unavailable", response(http.StatusServiceUnavailable, "2"), 2 * time.Second, true},
+		{"other status", response(http.StatusInternalServerError, "7"), 0, false},
+		{"missing", response(http.StatusTooManyRequests, ""), 0, false},
+		{"garbage", response(http.StatusTooManyRequests, "soon"), 0, false},
+		{"negative", response(http.StatusTooManyRequests, "-5"), 0, true},
+		{"capped", response(http.StatusTooManyRequests, "86400"), MaxRetryAfter, true},
+		{"past date", response(http.StatusTooManyRequests, "Mon, 02 Jan 2006 15:04:05 GMT"), 0, true},
+		{"far date", response(http.StatusTooManyRequests, time.Now().Add(48*time.Hour).UTC().Format(http.TimeFormat)),
+			MaxRetryAfter, true},
+	}
+
+	for _, tt := range tests {
+		delay, ok := RetryAfter(tt.resp)
+		if delay != tt.delay || ok != tt.ok {
+			t.Errorf("%s: RetryAfter() = %s, %v, want %s, %v", tt.name, delay, ok, tt.delay, tt.ok)
+		}
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if delay, ok := RetryAfter(response(http.StatusTooManyRequests, date)); !ok ||
+		delay <= 58*time.Second || delay > time.Minute {
+		t.Errorf("RetryAfter(%s) = %s, %v", date, delay, ok)
+	}
+}
+
+func TestCheckRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *http.Response
+		want bool
+	}{
+		{"ok", response(http.StatusOK, ""), false},
+		{"server error", response(http.StatusBadGateway, ""), true},
+		{"short retry-after", response(http.StatusTooManyRequests, "1"), true},
+		{"long retry-after left to breaker", response(http.StatusServiceUnavailable, "60"), false},
+	}
+
+	for _, tt := range tests {
+		retry, err := CheckRetry(context.Background(), tt.resp, nil)
+		if err != nil {
+			t.Errorf("%s: CheckRetry() error = %v", tt.name, err)
+		}
+
+		if retry != tt.want {
+			t.Errorf("%s: CheckRetry() = %v, want %v", tt.name, retry, tt.want)
+		}
+	}
+}
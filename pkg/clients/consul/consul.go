@@ -1,17 +1,26 @@
 package consul
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/tb0hdan/idun/pkg/breaker"
 	"github.com/tb0hdan/idun/pkg/clients/apiclient"
 )
 
@@ -20,14 +29,45 @@ const (
 	ConsulAdvertisedService = "idun"
 	Environment             = "test"
 	ErrMsg                  = "Consul registration aborted."
+	// health check.
+	CheckInterval = "10s"
+	CheckTimeout  = "5s"
+	// DeregisterAfter - Consul removes worker that failed checks for this long.
+	DeregisterAfter = "5m"
+	// KVPrefix - worker tunables, key is option name, i.e. idun/config/max-run-time = 300s.
+	KVPrefix = "idun/config/"
+	// CrawledPrefix - recently crawled domains, value is claim time in unix seconds.
+	CrawledPrefix = "idun/crawled/"
+	// SweepEvery - how often crawled keys older than registry window are deleted.
+	SweepEvery = time.Hour
+	// KVWait - blocking query timeout.
+	KVWait = 5 * time.Minute
+	// KVMinInterval - pause between queries that returned without changes.
+	KVMinInterval = time.Second
 )
 
+var ErrBadStatus = errors.New("unexpected consul response") // nolint:gochecknoglobals
+
+type ConsulCheck struct {
+	HTTP                           string `json:"HTTP,omitempty"`
+	Interval                       string `json:"Interval,omitempty"`
+	Timeout                        string `json:"Timeout,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
 type ConsulRegistration struct {
-	ID      string   `json:"ID"`
-	Name    string   `json:"Name,omitempty"`
-	Address string   `json:"Address,omitempty"`
-	Port    int      `json:"Port,omitempty"`
-	Tags    []string `json:"Tags,omitempty"`
+	ID      string       `json:"ID"`
+	Name    string       `json:"Name,omitempty"`
+	Address string       `json:"Address,omitempty"`
+	Port    int          `json:"Port,omitempty"`
+	Tags    []string     `json:"Tags,omitempty"`
+	Check   *ConsulCheck `json:"Check,omitempty"`
+}
+
+type kvPair struct {
+	Key         string `json:"Key"`
+	Value       string `json:"Value"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
 }
 
 type Client struct {
@@ -35,8 +75,12 @@ type Client struct {
 	logger                *log.Logger
 	advertisedPort        int
 	advertisedServiceName string
+	instance              string
+	sweepLock             sync.Mutex
+	swept                 time.Time
 }
 
+// getID - unique per running instance, hostname alone is shared by containers with host networking.
 func (cc *Client) getID() (string, error) {
 	hostName, err := os.Hostname()
 	if err != nil {
@@ -45,7 +89,7 @@ func (cc *Client) getID() (string, error) {
 		return "", err
 	}
 
-	return fmt.Sprintf("%s_%s_%s", Environment, hostName, "idun"), nil
+	return fmt.Sprintf("%s_%s_%s_%s", Environment, hostName, cc.advertisedServiceName, cc.instance), nil
 }
 
 func (cc *Client) SetAdvertisedPort(port int) {
@@ -73,23 +117,21 @@ func (cc *Client) Register() { // nolint:funlen
 			continue
 		}
 		//
-		if addr.String() == "127.0.0.1/8" {
-			continue
-		}
-		//
 		ipAddr, _, err := net.ParseCIDR(addr.String())
 		//
 		if err != nil {
 			continue
 		}
+		// Consul has to reach health check from outside
+		if ipAddr.IsLoopback() || ipAddr.IsLinkLocalUnicast() || ipAddr.IsUnspecified() {
+			continue
+		}
 
 		validAddrs = append(validAddrs, ipAddr.String())
 	}
-	//
-	ID, err := cc.getID()
-	//
-	if err != nil {
-		log.Error("Could not get host ID." + ErrMsg)
+
+	if len(validAddrs) == 0 {
+		log.Error("No usable interface addresses." + ErrMsg)
 
 		return
 	}
@@ -97,9 +139,13 @@ func (cc *Client) Register() { // nolint:funlen
 	if cc.advertisedPort == 0 {
 		cc.advertisedPort = ConsulAdvertisedPort
 	}
+	//
+	ID, err := cc.getID()
+	//
+	if err != nil {
+		log.Error("Could not get host ID." + ErrMsg)
 
-	if len(cc.advertisedServiceName) == 0 {
-		cc.advertisedServiceName = ConsulAdvertisedService
+		return
 	}
 	//
 	// Use first one. Works for Docker. Maybe will be fixed later for host systems.
@@ -109,6 +155,12 @@ func (cc *Client) Register() { // nolint:funlen
 		Address: validAddrs[0],
 		Port:    cc.advertisedPort,
 		Tags:    []string{Environment, "worker"},
+		Check: &ConsulCheck{
+			HTTP:                           fmt.Sprintf("http://%s/health", net.JoinHostPort(validAddrs[0], strconv.Itoa(cc.advertisedPort))),
+			Interval:                       CheckInterval,
+			Timeout:                        CheckTimeout,
+			DeregisterCriticalServiceAfter: DeregisterAfter,
+		},
 	}
 
 	data, err := json.Marshal(request)
@@ -202,9 +254,282 @@ func (cc *Client) GetServices() {
 	defer resp.Body.Close()
 }
 
+// GetKV - keys under prefix (with prefix stripped) and Consul index. Non-zero index makes it
+// a blocking query that returns once keys change or wait time passes.
+func (cc *Client) GetKV(ctx context.Context, prefix string, index uint64) (map[string]string, uint64, error) {
+	query := url.Values{}
+	query.Set("recurse", "true")
+
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", KVWait.String())
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet,
+		cc.consulURL+"/v1/kv/"+prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := apiclient.PrepareClient(cc.logger).Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	values := make(map[string]string)
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		// no keys under prefix
+		return values, newIndex, nil
+	case http.StatusOK:
+	default:
+		return nil, 0, fmt.Errorf("%w: %s", ErrBadStatus, resp.Status)
+	}
+
+	pairs := make([]kvPair, 0)
+	if err = json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, 0, err
+	}
+
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, prefix)
+		// folders
+		if len(key) == 0 || strings.HasSuffix(key, "/") {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		values[key] = strings.TrimSpace(string(value))
+	}
+
+	return values, newIndex, nil
+}
+
+// WatchKV - call onChange with keys under prefix every time they change, until context is cancelled.
+func (cc *Client) WatchKV(ctx context.Context, prefix string, index uint64, onChange func(values map[string]string)) {
+	retry := &breaker.Backoff{Min: time.Second, Max: time.Minute}
+
+	for ctx.Err() == nil {
+		values, newIndex, err := cc.GetKV(ctx, prefix, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := retry.Next()
+			log.Errorf("Consul KV watch failed, retrying in %s: %+v", delay, err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+
+			continue
+		}
+
+		retry.Reset()
+		// index went backwards (i.e. Consul restore), start over
+		if newIndex < index {
+			index = 0
+
+			continue
+		}
+
+		if newIndex == index {
+			select {
+			case <-ctx.Done():
+			case <-time.After(KVMinInterval):
+			}
+
+			continue
+		}
+
+		index = newIndex
+		onChange(values)
+	}
+}
+
+// getKey - single key value and its modify index, zero index when key doesn't exist.
+func (cc *Client) getKey(key string) (string, uint64, error) {
+	req, err := retryablehttp.NewRequest(http.MethodGet, cc.consulURL+"/v1/kv/"+key, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp, err := apiclient.PrepareClient(cc.logger).Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return "", 0, nil
+	case http.StatusOK:
+	default:
+		return "", 0, fmt.Errorf("%w: %s", ErrBadStatus, resp.Status)
+	}
+
+	pairs := make([]kvPair, 0)
+	if err = json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return "", 0, err
+	}
+
+	if len(pairs) == 0 {
+		return "", 0, nil
+	}
+
+	value, err := base64.StdEncoding.DecodeString(pairs[0].Value)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return string(value), pairs[0].ModifyIndex, nil
+}
+
+// sweep - delete crawled keys claimed before window. Check-and-set keeps keys claimed again meanwhile.
+func (cc *Client) sweep(window time.Duration) error {
+	req, err := retryablehttp.NewRequest(http.MethodGet, cc.consulURL+"/v1/kv/"+CrawledPrefix+"?recurse=true", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := apiclient.PrepareClient(cc.logger).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("%w: %s", ErrBadStatus, resp.Status)
+	}
+
+	pairs := make([]kvPair, 0)
+	if err = json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-window)
+	deleted := 0
+
+	for _, pair := range pairs {
+		value, _ := base64.StdEncoding.DecodeString(pair.Value)
+		// unparseable values are deleted too
+		if claimed, err := strconv.ParseInt(string(value), 10, 64); err == nil && time.Unix(claimed, 0).After(cutoff) {
+			continue
+		}
+
+		if err = cc.deleteKey(pair.Key, pair.ModifyIndex); err != nil {
+			return err
+		}
+
+		deleted++
+	}
+
+	log.Debugf("Deleted %d expired keys under %s", deleted, CrawledPrefix)
+
+	return nil
+}
+
+// deleteKey - delete key unless it was modified after index.
+func (cc *Client) deleteKey(key string, index uint64) error {
+	req, err := retryablehttp.NewRequest(http.MethodDelete, fmt.Sprintf("%s/v1/kv/%s?cas=%d", cc.consulURL, key, index), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := apiclient.PrepareClient(cc.logger).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrBadStatus, resp.Status)
+	}
+
+	return nil
+}
+
+// sweepIfDue - start sweep in background once per SweepEvery.
+func (cc *Client) sweepIfDue(window time.Duration) {
+	cc.sweepLock.Lock()
+	defer cc.sweepLock.Unlock()
+
+	if time.Since(cc.swept) < SweepEvery {
+		return
+	}
+
+	cc.swept = time.Now()
+
+	go func() {
+		if err := cc.sweep(window); err != nil {
+			log.Errorf("Could not delete expired keys under %s: %+v", CrawledPrefix, err)
+		}
+	}()
+}
+
+// Claim - types.RegistryInterface on Consul KV. Check-and-set on modify index makes sure
+// only one of concurrent workers wins the claim. Expired claims are deleted periodically.
+func (cc *Client) Claim(domain string, window time.Duration) (bool, error) {
+	cc.sweepIfDue(window)
+
+	key := CrawledPrefix + url.PathEscape(domain)
+
+	value, index, err := cc.getKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	if claimed, err := strconv.ParseInt(value, 10, 64); err == nil && now.Sub(time.Unix(claimed, 0)) < window {
+		return false, nil
+	}
+
+	req, err := retryablehttp.NewRequest(http.MethodPut,
+		fmt.Sprintf("%s/v1/kv/%s?cas=%d", cc.consulURL, key, index), strings.NewReader(strconv.FormatInt(now.Unix(), 10)))
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := apiclient.PrepareClient(cc.logger).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%w: %s", ErrBadStatus, resp.Status)
+	}
+
+	var ok bool
+	if err = json.NewDecoder(resp.Body).Decode(&ok); err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
 func NewConsul(consulURL string, logger *log.Logger) *Client {
+	instance := make([]byte, 4)
+	_, _ = rand.Read(instance)
+
 	return &Client{
-		consulURL: consulURL,
-		logger:    logger,
+		consulURL:             consulURL,
+		logger:                logger,
+		advertisedServiceName: ConsulAdvertisedService,
+		instance:              hex.EncodeToString(instance),
 	}
 }
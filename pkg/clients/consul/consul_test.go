@@ -0,0 +1,59 @@
+package consul
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	pairs := []kvPair{
+		{Key: CrawledPrefix + "fresh.com", Value: strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), ModifyIndex: 1},
+		{Key: CrawledPrefix + "expired.com", Value: strconv.FormatInt(now.Add(-48*time.Hour).Unix(), 10), ModifyIndex: 2},
+		{Key: CrawledPrefix + "garbage.com", Value: "garbage", ModifyIndex: 3},
+	}
+
+	for i := range pairs {
+		pairs[i].Value = base64.StdEncoding.EncodeToString([]byte(pairs[i].Value))
+	}
+
+	var (
+		lock    sync.Mutex
+		deleted []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_ = json.NewEncoder(w).Encode(pairs)
+		case http.MethodDelete:
+			lock.Lock()
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/v1/kv/")+"@"+r.URL.Query().Get("cas"))
+			lock.Unlock()
+			_, _ = w.Write([]byte("true"))
+		}
+	}))
+	defer srv.Close()
+
+	cc := NewConsul(srv.URL, log.New())
+	if err := cc.sweep(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(deleted)
+
+	want := []string{CrawledPrefix + "expired.com@2", CrawledPrefix + "garbage.com@3"}
+	if strings.Join(deleted, ",") != strings.Join(want, ",") {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+}
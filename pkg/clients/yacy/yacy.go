@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/tb0hdan/idun/pkg/config"
 	"github.com/tb0hdan/idun/pkg/crawler/crawlertools"
 	"github.com/tb0hdan/idun/pkg/types"
 )
@@ -137,7 +138,7 @@ func GetAllRemoteHosts(remoteURLs []string, domainCh chan string) {
 	wg.Wait()
 }
 
-func CrawlYacyHosts(apiBase, apiHost string, address string, debugMode bool, s types.APIServerInterface) {
+func CrawlYacyHosts(cfg *config.Config, apiHost string, address string, s types.APIServerInterface) {
 	domainsCh := make(chan string)
 
 	target := apiHost + PeerURL
@@ -155,7 +156,7 @@ func CrawlYacyHosts(apiBase, apiHost string, address string, debugMode bool, s t
 
 	go func() {
 		for domain := range domainsCh {
-			crawlertools.RunCrawl(apiBase, domain, address, debugMode)
+			crawlertools.RunCrawl(cfg, domain, address, nil)
 
 			// time to empty out Cache
 			for {
@@ -164,7 +165,7 @@ func CrawlYacyHosts(apiBase, apiHost string, address string, debugMode bool, s t
 					break
 				}
 
-				crawlertools.RunCrawl(apiBase, domain, address, debugMode)
+				crawlertools.RunCrawl(cfg, domain, address, nil)
 			}
 		}
 	}()
@@ -0,0 +1,367 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const (
+	// EnvPrefix - every option can be set with IDUN_<OPTION>, i.e. IDUN_MAX_RUN_TIME=300s.
+	EnvPrefix = "IDUN_"
+	// EnvConfigFile - alternative to -config flag.
+	EnvConfigFile = EnvPrefix + "CONFIG"
+	// EnvInherited - effective leader config passed to crawler children.
+	EnvInherited = EnvPrefix + "INHERITED_CONFIG"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported config field type") // nolint:gochecknoglobals
+	ErrUnknownOption   = errors.New("unknown config option")         // nolint:gochecknoglobals
+)
+
+// Config - runtime tunables.
+//
+// Precedence, lowest to highest: built-in defaults, config file (-config or IDUN_CONFIG),
+// environment variables (IDUN_ + upper-cased option name, dashes replaced by underscores), command line flags.
+// Crawler children receive effective leader config through IDUN_INHERITED_CONFIG instead of defaults, file and env.
+type Config struct {
+	APIBase string `yaml:"apiBase" json:"apiBase" help:"API server base URL"`
+	Debug   bool   `yaml:"debug" json:"debug" help:"Enable colly/crawler debugging"`
+	// crawler
+	MaxRunTime       time.Duration `yaml:"max-run-time" json:"max-run-time" help:"Maximum crawl run time per domain"`
+	Parallelism      int           `yaml:"parallelism" json:"parallelism" help:"Parallel requests per crawled domain"`
+	RandomDelay      time.Duration `yaml:"random-delay" json:"random-delay" help:"Maximum random delay added between requests to the same host"`
+	MaxDomainsInMap  int           `yaml:"max-domains-in-map" json:"max-domains-in-map" help:"Discovered domains buffered before submission"`
+	MemoryLimit      uint64        `yaml:"memory-limit" json:"memory-limit" help:"Crawler memory limit in bytes, lowered to container memory limit split between workers"`
+	HeadCheckTimeout time.Duration `yaml:"head-check-timeout" json:"head-check-timeout" help:"HEAD check timeout"`
+	BannedExtensions []string      `yaml:"banned-extensions" json:"banned-extensions" help:"Comma separated file extensions that are never fetched"`
+	IgnoreNoFollow   []string      `yaml:"ignore-nofollow" json:"ignore-nofollow" help:"Comma separated domains whose nofollow links are followed anyway"`
+	RobotsAgents     []string      `yaml:"robots-agents" json:"robots-agents" help:"Comma separated robots.txt product tokens, derived from User-Agent when empty"`
+	Scope            string        `yaml:"scope" json:"scope" help:"Crawl scope: host, subdomains or registrable"`
+	StripWWW         bool          `yaml:"strip-www" json:"strip-www" help:"Treat www.example.com and example.com as the same domain"`
+	BannedCIDRsFile  string        `yaml:"banned-cidrs-file" json:"banned-cidrs-file" help:"File with banned networks, one CIDR per line. Replaces built-in list"`
+	IPLimits         []string      `yaml:"ip-limits" json:"ip-limits" help:"Comma separated request limits per network, i.e. ipv4/32=120/5m,ipv4/24=480/5m"`
+	BannedCIDRs      []string      `yaml:"banned-cidrs" json:"banned-cidrs" help:"Comma separated list of additional banned networks"`
+	// worker
+	InProcess        bool          `yaml:"inprocess" json:"inprocess" help:"Run crawlers inside worker process instead of subprocesses. Trusted hosts only."`
+	OvercommitRatio  int64         `yaml:"overcommit" json:"overcommit" help:"Over commit ratio for workers"`
+	DomainsExpires   int64         `yaml:"domains-expires" json:"domains-expires" help:"Expiration in seconds for local domains cache"`
+	DataDir          string        `yaml:"data-dir" json:"data-dir" help:"Directory for persistent worker data"`
+	QueueMaxSize     int           `yaml:"queue-max-size" json:"queue-max-size" help:"Maximum amount of domains in local queue, 0 - unlimited"`
+	GetDomainsRetry  time.Duration `yaml:"get-domains-retry" json:"get-domains-retry" help:"Initial delay before retrying failed domains request, grows exponentially"`
+	CrawlFilterRetry time.Duration `yaml:"crawl-filter-retry" json:"crawl-filter-retry" help:"Initial delay before replaying spooled filter requests"`
+	SpoolMaxBytes    int64         `yaml:"spool-max-bytes" json:"spool-max-bytes" help:"Maximum spool size for unsent filter requests, 0 - unlimited"`
+	Registry         string        `yaml:"registry" json:"registry" help:"Recently crawled registry shared by workers: none, file or consul"`
+	RegistryDir      string        `yaml:"registry-dir" json:"registry-dir" help:"Directory of file registry, shared by workers on the host"`
+	RegistryWindow   time.Duration `yaml:"registry-window" json:"registry-window" help:"Domain claimed in registry is not crawled again for this long"`
+	ShutdownGrace    time.Duration `yaml:"shutdown-grace" json:"shutdown-grace" help:"Time given to running crawlers to finish on shutdown"`
+	ControlToken     string        `yaml:"control-token" json:"control-token" help:"X-Session-Token for /control endpoints, empty disables them" secret:"true"`
+	// servers
+	ReadTimeout  time.Duration `yaml:"read-timeout" json:"read-timeout" help:"HTTP server read timeout"`
+	WriteTimeout time.Duration `yaml:"write-timeout" json:"write-timeout" help:"HTTP server write timeout"`
+	IdleTimeout  time.Duration `yaml:"idle-timeout" json:"idle-timeout" help:"HTTP server idle timeout"`
+}
+
+func Default() *Config {
+	return &Config{
+		APIBase:          types.APIBase,
+		MaxRunTime:       types.CrawlerMaxRunTime,
+		Parallelism:      types.Parallelism,
+		RandomDelay:      types.RandomDelay,
+		MaxDomainsInMap:  types.MaxDomainsInMap,
+		MemoryLimit:      types.TwoGigs,
+		HeadCheckTimeout: types.HeadCheckTimeout,
+		BannedExtensions: []string{
+			"asc", "avi", "bmp", "dll", "doc", "docx", "exe", "iso", "jpg", "mp3", "odt",
+			"pdf", "png", "rar", "rdf", "svg", "tar", "tar.gz", "tar.bz2", "tgz", "txt",
+			"wav", "wmv", "xml", "xz", "zip",
+		},
+		IgnoreNoFollow:   []string{"blogspot.com", "github.io", "tumblr.com", "wordpress.com"},
+		Scope:            "subdomains",
+		IPLimits:         []string{"ipv4/32=120/5m", "ipv4/24=480/5m", "ipv6/64=120/5m", "ipv6/48=480/5m"},
+		OvercommitRatio:  1,
+		DomainsExpires:   86400,
+		DataDir:          "data",
+		GetDomainsRetry:  types.GetDomainsRetry,
+		CrawlFilterRetry: types.CrawlFilterRetry,
+		SpoolMaxBytes:    types.SpoolMaxBytes,
+		Registry:         "none",
+		RegistryDir:      "data",
+		RegistryWindow:   types.RegistryWindow,
+		ShutdownGrace:    types.ShutdownGrace,
+		ReadTimeout:      types.ReadTimeout,
+		WriteTimeout:     types.WriteTimeout,
+		IdleTimeout:      types.IdleTimeout,
+	}
+}
+
+// fieldValue - flag.Value for a single Config field.
+type fieldValue struct {
+	value reflect.Value
+}
+
+func (f *fieldValue) String() string {
+	if !f.value.IsValid() {
+		return ""
+	}
+
+	switch v := f.value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case time.Duration:
+		return v.String()
+	}
+
+	return fmt.Sprint(f.value.Interface())
+}
+
+func (f *fieldValue) Set(raw string) error { // nolint:cyclop
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(raw)
+	case bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+
+		f.value.SetBool(parsed)
+	case int, int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		f.value.SetInt(parsed)
+	case uint64:
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		f.value.SetUint(parsed)
+	case time.Duration:
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+
+		f.value.SetInt(int64(parsed))
+	case []string:
+		items := make([]string, 0)
+
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, f.value.Type())
+	}
+
+	return nil
+}
+
+func (f *fieldValue) IsBoolFlag() bool {
+	return f.value.IsValid() && f.value.Kind() == reflect.Bool
+}
+
+// options - option name to field mapping.
+func (c *Config) options() map[string]*fieldValue {
+	options := make(map[string]*fieldValue)
+	value := reflect.ValueOf(c).Elem()
+
+	for idx := 0; idx < value.NumField(); idx++ {
+		options[value.Type().Field(idx).Tag.Get("yaml")] = &fieldValue{value: value.Field(idx)}
+	}
+
+	return options
+}
+
+// Clone - deep copy, slices are not shared.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.BannedExtensions = append([]string(nil), c.BannedExtensions...)
+	clone.IgnoreNoFollow = append([]string(nil), c.IgnoreNoFollow...)
+	clone.BannedCIDRs = append([]string(nil), c.BannedCIDRs...)
+	clone.IPLimits = append([]string(nil), c.IPLimits...)
+	clone.RobotsAgents = append([]string(nil), c.RobotsAgents...)
+
+	return &clone
+}
+
+// Apply - set option by name from its string form, same syntax as flags and env.
+func (c *Config) Apply(option, raw string) error {
+	field, ok := c.options()[option]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownOption, option)
+	}
+
+	return field.Set(raw)
+}
+
+func EnvName(option string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return yaml.UnmarshalStrict(data, c)
+}
+
+func (c *Config) loadEnv() error {
+	for option, field := range c.options() {
+		raw, ok := os.LookupEnv(EnvName(option))
+		if !ok {
+			continue
+		}
+
+		if err := field.Set(raw); err != nil {
+			return fmt.Errorf("%s: %w", EnvName(option), err)
+		}
+	}
+
+	return nil
+}
+
+// Env - environment for crawler children so they inherit effective config. Crawlers don't need secrets
+// (options tagged secret), those are left out as environment is readable by other processes of the user.
+func (c *Config) Env() ([]string, error) {
+	public := c.Clone()
+	value := reflect.ValueOf(public).Elem()
+	secrets := make([]string, 0)
+
+	for idx := 0; idx < value.NumField(); idx++ {
+		field := value.Type().Field(idx)
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+
+		value.Field(idx).Set(reflect.Zero(field.Type))
+		secrets = append(secrets, EnvName(field.Tag.Get("yaml"))+"=")
+	}
+
+	data, err := json.Marshal(public)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]string, 0, len(os.Environ())+1)
+
+	for _, variable := range os.Environ() {
+		secret := false
+
+		for _, prefix := range secrets {
+			if strings.HasPrefix(variable, prefix) {
+				secret = true
+
+				break
+			}
+		}
+
+		if !secret {
+			env = append(env, variable)
+		}
+	}
+
+	return append(env, EnvInherited+"="+string(data)), nil
+}
+
+// Loader - registers config flags and builds Config once flags are parsed.
+type Loader struct {
+	flagSet    *flag.FlagSet
+	configFile *string
+}
+
+// NewLoader - register -config and every Config option on flag set. Call before fs.Parse.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	loader := &Loader{
+		flagSet:    fs,
+		configFile: fs.String("config", os.Getenv(EnvConfigFile), "YAML config file"),
+	}
+	// flag defaults are shown in -help, parsed values are re-applied in Load
+	scratch := Default()
+	value := reflect.ValueOf(scratch).Elem()
+
+	for idx := 0; idx < value.NumField(); idx++ {
+		field := value.Type().Field(idx)
+		fs.Var(&fieldValue{value: value.Field(idx)}, field.Tag.Get("yaml"), field.Tag.Get("help"))
+	}
+
+	return loader
+}
+
+// Load - build config according to documented precedence. Call after fs.Parse.
+func (l *Loader) Load() (*Config, error) {
+	cfg := Default()
+
+	if inherited, ok := os.LookupEnv(EnvInherited); ok {
+		if err := json.Unmarshal([]byte(inherited), cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvInherited, err)
+		}
+	} else {
+		if len(*l.configFile) > 0 {
+			if err := cfg.loadFile(*l.configFile); err != nil {
+				return nil, fmt.Errorf("config file %s: %w", *l.configFile, err)
+			}
+		}
+
+		if err := cfg.loadEnv(); err != nil {
+			return nil, err
+		}
+	}
+
+	options := cfg.options()
+
+	var err error
+
+	l.flagSet.Visit(func(f *flag.Flag) {
+		field, ok := options[f.Name]
+		if !ok || err != nil {
+			return
+		}
+
+		err = field.Set(f.Value.String())
+	})
+
+	return cfg, err
+}
+
+// Live - config that is replaced at runtime (i.e. from Consul KV). Readers get consistent snapshot
+// and must not modify it.
+type Live struct {
+	value atomic.Value
+}
+
+func (l *Live) Get() *Config {
+	return l.value.Load().(*Config)
+}
+
+func (l *Live) Set(cfg *Config) {
+	l.value.Store(cfg)
+}
+
+func NewLive(cfg *Config) *Live {
+	live := &Live{}
+	live.Set(cfg)
+
+	return live
+}
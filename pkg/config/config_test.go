@@ -0,0 +1,49 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEnvLeavesSecretsOut(t *testing.T) {
+	t.Setenv(EnvName("control-token"), "from-env")
+	t.Setenv(EnvName("max-run-time"), "5m")
+
+	cfg := Default()
+	cfg.ControlToken = "secret"
+
+	env, err := cfg.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inherited string
+
+	for _, variable := range env {
+		if strings.HasPrefix(variable, EnvName("control-token")+"=") {
+			t.Errorf("secret variable passed to children: %s", variable)
+		}
+
+		if strings.HasPrefix(variable, EnvInherited+"=") {
+			inherited = strings.TrimPrefix(variable, EnvInherited+"=")
+		}
+	}
+
+	child := &Config{}
+	if err = json.Unmarshal([]byte(inherited), child); err != nil {
+		t.Fatal(err)
+	}
+
+	if child.ControlToken != "" {
+		t.Errorf("inherited control token = %q, want empty", child.ControlToken)
+	}
+
+	if child.MaxRunTime != cfg.MaxRunTime {
+		t.Errorf("inherited max run time = %s, want %s", child.MaxRunTime, cfg.MaxRunTime)
+	}
+
+	if cfg.ControlToken != "secret" {
+		t.Errorf("Env changed config")
+	}
+}
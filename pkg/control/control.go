@@ -0,0 +1,296 @@
+package control
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	sigar "github.com/cloudfoundry/gosigar"
+	"github.com/gorilla/mux"
+
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const PathPrefix = "/control"
+
+var (
+	ErrDraining = errors.New("worker is draining") // nolint:gochecknoglobals
+	// Default - per-process controller.
+	Default = New() // nolint:gochecknoglobals
+)
+
+// CrawlStatus - running crawl. PID is that of worker itself for in-process crawls.
+type CrawlStatus struct {
+	PID     int       `json:"pid"`
+	Domain  string    `json:"domain"`
+	Started time.Time `json:"started"`
+	RSS     uint64    `json:"rss"`
+}
+
+type Crawl struct {
+	lock    sync.Mutex
+	pid     int
+	domain  string
+	started time.Time
+}
+
+// SetPID - record crawler subprocess. Safe to call on nil crawl (untracked runs).
+func (c *Crawl) SetPID(pid int) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	c.pid = pid
+	c.lock.Unlock()
+}
+
+// PID - crawler subprocess, 0 until started.
+func (c *Crawl) PID() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.pid
+}
+
+func (c *Crawl) snapshot() CrawlStatus {
+	snapshot := CrawlStatus{PID: c.PID(), Domain: c.domain, Started: c.started}
+
+	if snapshot.PID > 0 {
+		pm := sigar.ProcMem{}
+		if err := pm.Get(snapshot.PID); err == nil {
+			snapshot.RSS = pm.Resident
+		}
+	}
+
+	return snapshot
+}
+
+type Status struct {
+	Paused   bool          `json:"paused"`
+	Draining bool          `json:"draining"`
+	Crawls   []CrawlStatus `json:"crawls"`
+}
+
+// Controller - pause/resume/drain state of the worker and its running crawls.
+type Controller struct {
+	lock     sync.Mutex
+	paused   bool
+	draining bool
+	crawls   map[*Crawl]struct{}
+	// closed on state change, waiters re-check state
+	changed chan struct{}
+	drained chan struct{}
+}
+
+func (c *Controller) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	if c.draining && len(c.crawls) == 0 {
+		select {
+		case <-c.drained:
+		default:
+			close(c.drained)
+		}
+	}
+}
+
+func (c *Controller) Pause() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.paused = true
+	c.notify()
+}
+
+func (c *Controller) Resume() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.paused = false
+	c.notify()
+}
+
+// Drain - stop taking new work, Drained is closed once running crawls finish.
+func (c *Controller) Drain() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.draining = true
+	c.notify()
+}
+
+func (c *Controller) Drained() <-chan struct{} {
+	return c.drained
+}
+
+// Wait - block while worker is paused or draining.
+func (c *Controller) Wait(ctx context.Context) error {
+	for {
+		c.lock.Lock()
+		runnable := !c.paused && !c.draining
+		changed := c.changed
+		c.lock.Unlock()
+
+		if runnable {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Begin - register crawl of domain. Fails when draining so item can be returned to queue.
+func (c *Controller) Begin(domain string) (*Crawl, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.draining {
+		return nil, ErrDraining
+	}
+
+	crawl := &Crawl{domain: domain, started: time.Now()}
+	c.crawls[crawl] = struct{}{}
+
+	return crawl, nil
+}
+
+func (c *Controller) End(crawl *Crawl) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.crawls, crawl)
+	c.notify()
+}
+
+func (c *Controller) running() []*Crawl {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	crawls := make([]*Crawl, 0, len(c.crawls))
+	for crawl := range c.crawls {
+		crawls = append(crawls, crawl)
+	}
+
+	return crawls
+}
+
+// signal - send sig to running crawler subprocesses. In-process crawls stop with worker context instead.
+func (c *Controller) signal(sig syscall.Signal) {
+	self := os.Getpid()
+
+	for _, crawl := range c.running() {
+		// crawler subprocesses lead their own process groups
+		if pid := crawl.PID(); pid > 0 && pid != self {
+			_ = syscall.Kill(-pid, sig)
+		}
+	}
+}
+
+// Shutdown - drain, forward SIGTERM to crawler subprocesses and wait for them up to grace period.
+// Crawlers still running after that are killed, false is returned.
+func (c *Controller) Shutdown(grace time.Duration) bool {
+	c.Drain()
+	c.signal(syscall.SIGTERM)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-c.Drained():
+		return true
+	case <-timer.C:
+	}
+
+	c.signal(syscall.SIGKILL)
+
+	return false
+}
+
+func (c *Controller) Status() *Status {
+	c.lock.Lock()
+	status := &Status{Paused: c.paused, Draining: c.draining, Crawls: make([]CrawlStatus, 0, len(c.crawls))}
+	c.lock.Unlock()
+
+	for _, crawl := range c.running() {
+		status.Crawls = append(status.Crawls, crawl.snapshot())
+	}
+
+	sort.Slice(status.Crawls, func(i, j int) bool {
+		return status.Crawls[i].Started.Before(status.Crawls[j].Started)
+	})
+
+	return status
+}
+
+func New() *Controller {
+	return &Controller{
+		crawls:  make(map[*Crawl]struct{}),
+		changed: make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(body)
+}
+
+// Handler - control endpoints under PathPrefix, authenticated with X-Session-Token.
+// Token is looked up on every request, so it can change at runtime. Empty token disables them.
+func Handler(c *Controller, token func() string) http.Handler {
+	r := mux.NewRouter()
+	api := r.PathPrefix(PathPrefix).Subrouter()
+	api.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := token()
+			if len(token) == 0 {
+				writeJSON(w, http.StatusForbidden, &types.JSONResponse{Code: http.StatusForbidden, Message: "control API is disabled"})
+
+				return
+			}
+
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Session-Token")), []byte(token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, &types.JSONResponse{Code: http.StatusUnauthorized, Message: "invalid session token"})
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	action := func(fn func()) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fn()
+			writeJSON(w, http.StatusOK, c.Status())
+		}
+	}
+
+	api.HandleFunc("/pause", action(c.Pause)).Methods(http.MethodPost)
+	api.HandleFunc("/resume", action(c.Resume)).Methods(http.MethodPost)
+	api.HandleFunc("/drain", action(c.Drain)).Methods(http.MethodPost)
+	api.HandleFunc("/status", action(func() {})).Methods(http.MethodGet)
+
+	return r
+}
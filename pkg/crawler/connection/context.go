@@ -0,0 +1,56 @@
+package connection
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ContextTransport - RoundTripper binding requests to ctx as well as their own context.
+// colly requests ignore crawl context, this way they are aborted once crawl is over.
+type ContextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+// doneBody - response body calling done once it is closed.
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *doneBody) Close() error {
+	defer b.once.Do(b.done)
+
+	return b.ReadCloser.Close()
+}
+
+func (t *ContextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	resp.Body = &doneBody{ReadCloser: resp.Body, done: cancel}
+
+	return resp, nil
+}
+
+// NewContextTransport - wrap base.
+func NewContextTransport(ctx context.Context, base http.RoundTripper) *ContextTransport {
+	return &ContextTransport{ctx: ctx, base: base}
+}
@@ -0,0 +1,42 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContextTransport(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// client deadline gives every request its own context
+	client := &http.Client{Transport: NewContextTransport(ctx, http.DefaultTransport), Timeout: time.Minute}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	started := time.Now()
+
+	_, err := client.Get(srv.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("request error = %v, want %v", err, context.Canceled)
+	}
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("request took %s after crawl context was cancelled", elapsed)
+	}
+}
@@ -0,0 +1,151 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinHostDelay - requests to the same host are never sent closer than this.
+const MinHostDelay = time.Second
+
+// Scheduler - per host pacing. Requests to the same host are spaced by host delay plus random jitter,
+// requests to different hosts don't wait for each other.
+type Scheduler struct {
+	lock   sync.Mutex
+	next   map[string]time.Time
+	delay  func(u *url.URL) time.Duration
+	jitter time.Duration
+}
+
+// Wait - block until request to URL host may be sent. Slots are handed out in call order,
+// requests that can't get theirs before ctx deadline fail right away and cancelled ones give it back.
+func (s *Scheduler) Wait(ctx context.Context, u *url.URL) error {
+	// may fetch robots.txt, keep it outside of lock
+	delay := s.delay(u)
+	if delay < MinHostDelay {
+		delay = MinHostDelay
+	}
+
+	if s.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.jitter))) // nolint:gosec
+	}
+
+	host := strings.ToLower(u.Host)
+	now := time.Now()
+
+	s.lock.Lock()
+	at := s.next[host]
+
+	if at.Before(now) {
+		at = now
+	}
+
+	wait := at.Sub(now)
+	if deadline, ok := ctx.Deadline(); ok && at.After(deadline) {
+		s.lock.Unlock()
+
+		return fmt.Errorf("%w: %s needs to wait %s", ErrRateLimited, host, wait)
+	}
+
+	s.next[host] = at.Add(delay)
+	s.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		s.lock.Lock()
+		// unless later requests were scheduled after it
+		if s.next[host].Equal(at.Add(delay)) {
+			s.next[host] = at
+		}
+		s.lock.Unlock()
+
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// NewScheduler - delay returns minimum spacing for URL host, i.e. robots.txt Crawl-delay.
+func NewScheduler(delay func(u *url.URL) time.Duration, jitter time.Duration) *Scheduler {
+	return &Scheduler{next: make(map[string]time.Time), delay: delay, jitter: jitter}
+}
+
+// PacedTransport - RoundTripper that waits for scheduler slot of request host. Parallel requests
+// are capped per host, so requests waiting for one host don't hold up others.
+type PacedTransport struct {
+	base        http.RoundTripper
+	scheduler   *Scheduler
+	parallelism int
+	lock        sync.Mutex
+	hosts       map[string]chan struct{}
+}
+
+// acquire - take one of host parallel request slots.
+func (t *PacedTransport) acquire(ctx context.Context, host string) (func(), error) {
+	t.lock.Lock()
+	slots, ok := t.hosts[host]
+
+	if !ok {
+		slots = make(chan struct{}, t.parallelism)
+		t.hosts[host] = slots
+	}
+	t.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	}
+}
+
+func (t *PacedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.acquire(req.Context(), strings.ToLower(req.URL.Host))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = t.scheduler.Wait(req.Context(), req.URL); err != nil {
+		release()
+
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+
+		return nil, err
+	}
+	// slot is held until response is read
+	resp.Body = &doneBody{ReadCloser: resp.Body, done: release}
+
+	return resp, nil
+}
+
+// NewPacedTransport - wrap base with scheduler, allowing up to parallelism requests per host.
+func NewPacedTransport(base http.RoundTripper, scheduler *Scheduler, parallelism int) *PacedTransport {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	return &PacedTransport{
+		base:        base,
+		scheduler:   scheduler,
+		parallelism: parallelism,
+		hosts:       make(map[string]chan struct{}),
+	}
+}
@@ -0,0 +1,107 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSchedulerWait(t *testing.T) {
+	u, _ := url.Parse("http://example.com/")
+	hour := func(*url.URL) time.Duration { return time.Hour }
+
+	tests := []struct {
+		name string
+		wait func(s *Scheduler) error
+		err  error
+	}{
+		{
+			name: "first request",
+			wait: func(s *Scheduler) error { return s.Wait(context.Background(), u) },
+		},
+		{
+			name: "slot after deadline",
+			wait: func(s *Scheduler) error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+
+				return s.Wait(ctx, u)
+			},
+			err: ErrRateLimited,
+		},
+		{
+			name: "cancelled",
+			wait: func(s *Scheduler) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+
+				return s.Wait(ctx, u)
+			},
+			err: context.Canceled,
+		},
+	}
+
+	s := NewScheduler(hour, 0)
+
+	for _, tt := range tests {
+		if err := tt.wait(s); !errors.Is(err, tt.err) {
+			t.Errorf("%s: Wait() = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	// neither failed request kept its slot
+	if next := time.Until(s.next["example.com"]); next > time.Hour+time.Minute {
+		t.Errorf("next slot in %s, want about an hour", next)
+	}
+}
+
+func TestPacedTransport(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	var slow, fast *url.URL
+
+	slow, _ = url.Parse(srv.URL + "/slow")
+	fast, _ = url.Parse(srv.URL + "/fast")
+	// the same server under another host name
+	fast.Host = "localhost:" + fast.Port()
+
+	scheduler := NewScheduler(func(*url.URL) time.Duration { return 0 }, 0)
+	client := &http.Client{Transport: NewPacedTransport(http.DefaultTransport, scheduler, 1)}
+
+	done := make(chan struct{})
+
+	go func() {
+		if resp, err := client.Get(slow.String()); err == nil {
+			resp.Body.Close()
+		}
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// second request to busy host waits for its slot
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, slow.String(), nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second request to busy host: %v", err)
+	}
+	// other hosts are not held up
+	resp, err := client.Get(fast.String())
+	if err != nil {
+		t.Fatalf("request to other host: %v", err)
+	}
+
+	resp.Body.Close()
+	close(release)
+	<-done
+}
@@ -0,0 +1,75 @@
+package connection
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// nolint:gochecknoglobals
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// TLSInfo - negotiated TLS version and issuer of leaf certificate.
+type TLSInfo struct {
+	Version string
+	Issuer  string
+}
+
+func newTLSInfo(state *tls.ConnectionState) TLSInfo {
+	info := TLSInfo{Version: tlsVersions[state.Version]}
+	if len(info.Version) == 0 {
+		info.Version = fmt.Sprintf("0x%04X", state.Version)
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		issuer := state.PeerCertificates[0].Issuer
+		info.Issuer = issuer.CommonName
+
+		if len(info.Issuer) == 0 {
+			info.Issuer = issuer.String()
+		}
+	}
+
+	return info
+}
+
+// TLSTransport - RoundTripper remembering TLS connection details of the last response per host.
+type TLSTransport struct {
+	base  http.RoundTripper
+	lock  sync.Mutex
+	hosts map[string]TLSInfo
+}
+
+func (t *TLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.TLS == nil {
+		return resp, err
+	}
+
+	t.lock.Lock()
+	t.hosts[req.URL.Host] = newTLSInfo(resp.TLS)
+	t.lock.Unlock()
+
+	return resp, nil
+}
+
+// Get - TLS details of host (host:port as in URL), false for plain HTTP or hosts not requested yet.
+func (t *TLSTransport) Get(host string) (TLSInfo, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	info, ok := t.hosts[host]
+
+	return info, ok
+}
+
+// NewTLSTransport - wrap base.
+func NewTLSTransport(base http.RoundTripper) *TLSTransport {
+	return &TLSTransport{base: base, hosts: make(map[string]TLSInfo)}
+}
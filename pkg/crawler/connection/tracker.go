@@ -1,52 +1,427 @@
 package connection
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	log "github.com/sirupsen/logrus"
-	"github.com/tb0hdan/memcache"
+	"github.com/tb0hdan/idun/pkg/types"
 )
 
 const (
-	MaxConnectionsPerFiveMinutes = 32
-	FiveMinutesInSeconds         = 300
+	// LimitPath - leader endpoint used by crawler subprocesses.
+	LimitPath = "/limit"
+	// MaxWait - requests that would wait longer than this fail instead.
+	MaxWait = time.Minute
+	// prune full buckets this often.
+	pruneEvery = time.Minute
+	//
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+var (
+	ErrBadLimit    = errors.New("bad limit, expected ipv4/24=128/5m") // nolint:gochecknoglobals
+	ErrRateLimited = errors.New("rate limited")                       // nolint:gochecknoglobals
+	ErrNoAddress   = errors.New("no addresses")                       // nolint:gochecknoglobals
 )
 
+// Limit - Requests per Period for every network of Bits size, i.e. ipv4/24=128/5m.
+type Limit struct {
+	Family   string
+	Bits     int
+	Requests int
+	Period   time.Duration
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%s/%d=%d/%s", l.Family, l.Bits, l.Requests, l.Period)
+}
+
+// rate - tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+func ParseLimit(raw string) (Limit, error) {
+	network, rate, ok := strings.Cut(strings.TrimSpace(raw), "=")
+	if !ok {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	family, bits, ok := strings.Cut(network, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	requests, period, ok := strings.Cut(rate, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	limit := Limit{Family: family}
+
+	var err error
+
+	if limit.Bits, err = strconv.Atoi(bits); err != nil {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	if limit.Requests, err = strconv.Atoi(requests); err != nil {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	if limit.Period, err = time.ParseDuration(period); err != nil {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	maxBits := 32
+	if family == familyIPv6 {
+		maxBits = 128
+	} else if family != familyIPv4 {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	if limit.Bits < 1 || limit.Bits > maxBits || limit.Requests < 1 || limit.Period <= 0 {
+		return Limit{}, fmt.Errorf("%w: %s", ErrBadLimit, raw)
+	}
+
+	return limit, nil
+}
+
+func ParseLimits(raw []string) ([]Limit, error) {
+	limits := make([]Limit, 0, len(raw))
+
+	for _, item := range raw {
+		limit, err := ParseLimit(item)
+		if err != nil {
+			return nil, err
+		}
+
+		limits = append(limits, limit)
+	}
+
+	return limits, nil
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Tracker - token bucket per IP network. Every limit matching address must have a token for request to pass.
 type Tracker struct {
-	cache  *memcache.CacheType
-	logger *log.Logger
+	lock      sync.Mutex
+	limits    []Limit
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+// refill - bucket state at now, new buckets start full.
+func (t *Tracker) refill(key string, limit Limit, now time.Time) *bucket {
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), updated: now}
+		t.buckets[key] = b
+
+		return b
+	}
+
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*limit.rate())
+	b.updated = now
+
+	return b
+}
+
+// prune - forget buckets that refilled completely, they are equal to new ones.
+func (t *Tracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < pruneEvery {
+		return
+	}
+
+	t.lastPrune = now
+
+	for _, limit := range t.limits {
+		prefix := limit.String() + "|"
+
+		for key, b := range t.buckets {
+			if strings.HasPrefix(key, prefix) && now.Sub(b.updated) >= limit.Period {
+				delete(t.buckets, key)
+			}
+		}
+	}
+}
+
+// reserve - wait until every matching bucket has a token, take them when allowed and take is set.
+func (t *Tracker) reserve(ip string, take bool) (time.Duration, bool, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return 0, false, fmt.Errorf("%w: %s", ErrNoAddress, ip)
+	}
+
+	family := familyIPv6
+	if v4 := addr.To4(); v4 != nil {
+		addr, family = v4, familyIPv4
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	reserved := make([]*bucket, 0, len(t.limits))
+
+	var wait time.Duration
+
+	for _, limit := range t.limits {
+		if limit.Family != family {
+			continue
+		}
+
+		network := addr.Mask(net.CIDRMask(limit.Bits, len(addr)*8))
+		b := t.refill(limit.String()+"|"+network.String(), limit, now)
+
+		if b.tokens < 1 {
+			if missing := time.Duration((1 - b.tokens) / limit.rate() * float64(time.Second)); missing > wait {
+				wait = missing
+			}
+
+			continue
+		}
+
+		reserved = append(reserved, b)
+	}
+
+	if wait > 0 || !take {
+		return wait, wait == 0, nil
+	}
+
+	for _, b := range reserved {
+		b.tokens--
+	}
+
+	return 0, true, nil
+}
+
+func (t *Tracker) Reserve(ip string) (time.Duration, bool, error) {
+	return t.reserve(ip, true)
+}
+
+func (t *Tracker) Check(ip string) (time.Duration, bool, error) {
+	return t.reserve(ip, false)
+}
+
+// Handler - Reserve for crawler subprocesses, GET LimitPath?ip=address, Check with &check=true.
+func (t *Tracker) Handler(w http.ResponseWriter, r *http.Request) {
+	check, _ := strconv.ParseBool(r.URL.Query().Get("check"))
+
+	wait, allowed, err := t.reserve(r.URL.Query().Get("ip"), !check)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	body, err := json.Marshal(&reservation{Allowed: allowed, Wait: wait.Milliseconds()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	_, _ = w.Write(body)
 }
 
-func (t *Tracker) Check(domainName string) bool {
-	addrs, err := net.LookupIP(domainName)
+func New(limits []Limit) *Tracker {
+	return &Tracker{limits: limits, buckets: make(map[string]*bucket)}
+}
+
+type reservation struct {
+	Allowed bool  `json:"allowed"`
+	Wait    int64 `json:"wait_ms"`
+}
+
+// Remote - leader Tracker as seen from crawler subprocess.
+type Remote struct {
+	url    string
+	client *http.Client
+}
+
+func (r *Remote) query(ip string, check bool) (time.Duration, bool, error) {
+	resp, err := r.client.Get(r.url + "?ip=" + url.QueryEscape(ip) + "&check=" + strconv.FormatBool(check))
 	if err != nil {
-		return false
+		return 0, false, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("%w: limiter responded with %s", ErrRateLimited, resp.Status)
+	}
+
+	result := &reservation{}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return 0, false, err
+	}
+
+	return time.Duration(result.Wait) * time.Millisecond, result.Allowed, nil
+}
+
+func (r *Remote) Reserve(ip string) (time.Duration, bool, error) {
+	return r.query(ip, false)
+}
+
+func (r *Remote) Check(ip string) (time.Duration, bool, error) {
+	return r.query(ip, true)
+}
+
+// NewRemote - limiter served by leader at serverAddr.
+func NewRemote(serverAddr string) *Remote {
+	return &Remote{
+		url:    "http://" + serverAddr + LimitPath,
+		client: &http.Client{Timeout: types.HeadCheckTimeout},
+	}
+}
+
+// primaryIP - address connection most likely goes to, the first one resolved.
+func primaryIP(ctx context.Context, host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
 	if len(addrs) == 0 {
-		return false
-	}
-	// use cache
-	for _, addr := range addrs {
-		ipAddr := addr.String()
-		value, ok := t.cache.GetEx(fmt.Sprintf("conntrack_%s", ipAddr))
-		connectionCount := int64(1)
-		expirationDiff := int64(FiveMinutesInSeconds)
-		if ok {
-			currentConnectionCount := value.Value.(int64)
-			if currentConnectionCount > MaxConnectionsPerFiveMinutes {
-				return false
-			}
-			connectionCount = currentConnectionCount + 1
-			expirationDiff = value.Expires - time.Now().Unix()
+		return "", fmt.Errorf("%w: %s", ErrNoAddress, host)
+	}
+
+	return addrs[0].IP.String(), nil
+}
+
+// CheckHost - whether crawl of host can start now, no token is taken.
+func CheckHost(limiter types.LimiterInterface, host string) (time.Duration, bool, error) {
+	ip, err := primaryIP(context.Background(), host)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return limiter.Check(ip)
+}
+
+// Transport - RoundTripper that waits for limiter token before every request. Addresses are
+// taken from connections base dials, so token is taken for the address request goes to.
+// Before the first connection to host, its first resolved address is used.
+type Transport struct {
+	base    *http.Transport
+	limiter types.LimiterInterface
+	lock    sync.Mutex
+	hosts   map[string]string
+}
+
+// wait - take token for ip, waiting up to MaxWait for it.
+func (t *Transport) wait(ctx context.Context, ip string) error {
+	for {
+		wait, allowed, err := t.limiter.Reserve(ip)
+		if err != nil {
+			return err
+		}
+
+		if allowed {
+			return nil
+		}
+
+		if wait > MaxWait {
+			return fmt.Errorf("%w: %s needs to wait %s", ErrRateLimited, ip, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return ctx.Err()
+		case <-timer.C:
 		}
-		t.cache.SetEx(fmt.Sprintf("conntrack_%s", ipAddr), connectionCount, expirationDiff)
 	}
-	//
-	return true
 }
 
-func New(cache *memcache.CacheType, logger *log.Logger) *Tracker {
-	return &Tracker{cache: cache, logger: logger}
+// dialContext - wrap dial, remembering connected address of host.
+func (t *Transport) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		t.lock.Lock()
+		t.hosts[host] = ip
+		t.lock.Unlock()
+
+		return conn, nil
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+
+	t.lock.Lock()
+	ip, ok := t.hosts[host]
+	t.lock.Unlock()
+
+	if !ok {
+		// first contact, connected address is recorded by dialer
+		var err error
+
+		if ip, err = primaryIP(req.Context(), host); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.wait(req.Context(), ip); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// NewTransport - wrap base with limiter, base dialer is replaced with one that records connected addresses.
+func NewTransport(base *http.Transport, limiter types.LimiterInterface) *Transport {
+	t := &Transport{base: base, limiter: limiter, hosts: make(map[string]string)}
+
+	dial := base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	base.DialContext = t.dialContext(dial)
+
+	return t
 }
@@ -0,0 +1,74 @@
+package connection
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	tracker := New([]Limit{{Family: familyIPv4, Bits: 32, Requests: 2, Period: MaxWait * 10}})
+	client := &http.Client{Transport: NewTransport(cleanhttp.DefaultPooledTransport(), tracker)}
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"first request, token taken for resolved address", nil},
+		{"second request, token taken for connected address", nil},
+		{"out of tokens", ErrRateLimited},
+	}
+
+	for _, tt := range tests {
+		if _, allowed, _ := tracker.Check("127.0.0.1"); allowed != (tt.err == nil) {
+			t.Errorf("%s: Check() allowed = %v", tt.name, allowed)
+		}
+
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestTransportConcurrentFirstRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	tracker := New([]Limit{{Family: familyIPv4, Bits: 32, Requests: 2, Period: MaxWait * 10}})
+	client := &http.Client{Transport: NewTransport(cleanhttp.DefaultPooledTransport(), tracker)}
+	limited := make(chan bool, 4)
+
+	for i := 0; i < cap(limited); i++ {
+		go func() {
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			limited <- errors.Is(err, ErrRateLimited)
+		}()
+	}
+
+	passed := 0
+
+	for i := 0; i < cap(limited); i++ {
+		if !<-limited {
+			passed++
+		}
+	}
+
+	if passed != 2 {
+		t.Errorf("%d requests passed, want 2", passed)
+	}
+}
@@ -1,18 +1,20 @@
 package crawler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
 	"regexp"
 	"runtime"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	sigar "github.com/cloudfoundry/gosigar"
@@ -23,44 +25,64 @@ import (
 	"github.com/temoto/robotstxt"
 
 	"github.com/tb0hdan/idun/pkg/clients/apiclient"
+	"github.com/tb0hdan/idun/pkg/config"
+	"github.com/tb0hdan/idun/pkg/crawler/connection"
+	"github.com/tb0hdan/idun/pkg/crawler/extractors"
+	"github.com/tb0hdan/idun/pkg/crawler/progress"
+	"github.com/tb0hdan/idun/pkg/crawler/sitemap"
+	"github.com/tb0hdan/idun/pkg/domain"
+	"github.com/tb0hdan/idun/pkg/ippolicy"
+	"github.com/tb0hdan/idun/pkg/metrics"
+	"github.com/tb0hdan/idun/pkg/spool"
 	"github.com/tb0hdan/idun/pkg/types"
 	"github.com/tb0hdan/idun/pkg/utils"
 )
 
 var (
-	BannedExtensions = []string{ // nolint:gochecknoglobals
-		"asc", "avi", "bmp", "dll", "doc", "docx", "exe", "iso", "jpg", "mp3", "odt",
-		"pdf", "png", "rar", "rdf", "svg", "tar", "tar.gz", "tar.bz2", "tgz", "txt",
-		"wav", "wmv", "xml", "xz", "zip",
-	}
-
 	BannedLocalRedirects = map[string]string{ // nolint:gochecknoglobals
 		"www.president.gov.ua": "1",
 	}
 
-	BannedCIDRs = []string{
-		"10.0.0.0/8",
-		"127.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-	}
+	// Extractors - non-anchor sources of external hosts, reported but never followed.
+	Extractors = extractors.Default() // nolint:gochecknoglobals
+)
 
-	IgnoreNoFollow = map[string]string{ // nolint:gochecknoglobals
-		"blogspot.com":  "1",
-		"github.io":     "1",
-		"tumblr.com":    "1",
-		"wordpress.com": "1",
-	}
+// MaxRedirects - page redirects followed, same as Go default.
+const MaxRedirects = 10
+
+var (
+	ErrEmptyURL     = errors.New("cannot start with empty url")       // nolint:gochecknoglobals
+	ErrNotEnoughRAM = errors.New("will not start without enough RAM") // nolint:gochecknoglobals
+	ErrMemoryLimit  = errors.New("RAM limit exceeded")                // nolint:gochecknoglobals
+	ErrDisallowed   = errors.New("disallowed by robots.txt")          // nolint:gochecknoglobals
 )
 
+// ExitReason - crawl exit reason (metrics.Exit*) for CrawlURL result.
+func ExitReason(err error) string {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return metrics.ExitNormal
+	case errors.Is(err, ErrMemoryLimit):
+		return metrics.ExitMemoryLimit
+	case errors.Is(err, context.DeadlineExceeded):
+		return metrics.ExitTimeout
+	default:
+		return metrics.ExitError
+	}
+}
+
 type RoboTesterInterface interface {
 	GetRobots(path string) (robots *robotstxt.RobotsData, err error)
 	Test(path string) bool
 	GetDelay() time.Duration
+	Delay(rawURL string) time.Duration
+	GetSitemaps() []string
+	SetClient(client *http.Client)
+	SetProducts(products []string)
 	InitWithUA(ua string)
 }
 
-func SubmitOutgoingDomains(c *apiclient.Client, domains []string, serverAddr string) {
+func SubmitOutgoingDomains(c types.APIClientInterface, domains []string, serverAddr string) {
 	log.Println("Submit called: ", domains)
 	//
 	if len(domains) == 0 {
@@ -79,7 +101,7 @@ func SubmitOutgoingDomains(c *apiclient.Client, domains []string, serverAddr str
 	}
 
 	serverURL := fmt.Sprintf("http://%s/upload", serverAddr)
-	retryClient := apiclient.PrepareClient(c.Logger)
+	retryClient := apiclient.PrepareClient(c.GetLogger())
 	req, err := retryablehttp.NewRequest(http.MethodPost, serverURL, body)
 	//
 	if err != nil {
@@ -109,15 +131,20 @@ func SubmitOutgoingDomains(c *apiclient.Client, domains []string, serverAddr str
 	}
 }
 
-func FilterAndSubmit(domainMap map[string]struct{}, c *apiclient.Client, serverAddr, ua string) {
-	var (
-		banned bool
-	)
+// FilterAndSubmit - filter discovered domains through API and queue responsive ones at leader.
+// Outcomes are reported for leader metrics, crawler subprocess metrics aren't scraped.
+func FilterAndSubmit(cfg *config.Config, domainMap map[string]struct{}, c types.APIClientInterface, serverAddr, ua string,
+	reporter *progress.Reporter) {
 	domains := make([]string, 0, len(domainMap))
 
+	hosts := make([]string, 0, len(domainMap))
+	for host := range domainMap {
+		hosts = append(hosts, host)
+	}
+
 	// Be nice on servers and skip non-resolvable domains
-	for domain := range domainMap {
-		addrs, err := net.LookupHost(domain)
+	for _, name := range domain.NormalizeAll(hosts) {
+		addrs, err := net.LookupHost(name)
 		//
 		if err != nil {
 			continue
@@ -126,29 +153,17 @@ func FilterAndSubmit(domainMap map[string]struct{}, c *apiclient.Client, serverA
 		if len(addrs) == 0 {
 			continue
 		}
-		//
-		for _, addr := range addrs {
-			for _, cidr := range BannedCIDRs {
-				_, IPNet, err := net.ParseCIDR(cidr)
-				if err != nil {
-					continue
-				}
-				if IPNet.Contains(net.ParseIP(addr)) {
-					banned = true
-					break
-				}
-			}
-		}
-		if banned {
+		// Don't submit domains pointing to private / reserved networks
+		if ippolicy.Default.AnyBanned(addrs) {
 			continue
 		}
 
 		// Local filter. Some ISPs have redirects / links to policies for blocked sites
-		if _, banned := BannedLocalRedirects[domain]; banned {
+		if _, banned := BannedLocalRedirects[name]; banned {
 			continue
 		}
 		//
-		domains = append(domains, domain)
+		domains = append(domains, name)
 	}
 
 	// At this point in time domain list can be empty (broken, banned domains)
@@ -156,10 +171,28 @@ func FilterAndSubmit(domainMap map[string]struct{}, c *apiclient.Client, serverA
 		return
 	}
 
+	started := time.Now()
 	outgoing, err := c.FilterDomains(domains)
+	reporter.Filter(time.Since(started), err)
+
 	if err != nil {
 		log.Println("Filter failed with", err)
-		time.Sleep(types.CrawlFilterRetry)
+		// keep results for replay by leader once API is back
+		unsent, err := spool.New(cfg.DataDir, cfg.SpoolMaxBytes, c.GetLogger())
+		if err == nil {
+			err = unsent.Append(domains)
+		}
+
+		switch {
+		case err == nil:
+			reporter.Spool(len(domains), 0)
+		case errors.Is(err, spool.ErrSpoolFull):
+			reporter.Spool(0, len(domains))
+		}
+
+		if err != nil {
+			log.Error("Could not spool filter request: ", err)
+		}
 
 		return
 	}
@@ -169,7 +202,9 @@ func FilterAndSubmit(domainMap map[string]struct{}, c *apiclient.Client, serverA
 	}
 
 	// Don't crawl non-responsive domains (launching subprocess is expensive!)
-	checked := utils.HeadCheckDomains(outgoing, ua)
+	checked := utils.HeadCheckDomains(outgoing, ua, cfg.HeadCheckTimeout)
+	reporter.HeadChecks(len(checked), len(utils.DeduplicateSlice(outgoing))-len(checked))
+
 	toSubmit := make([]string, 0)
 
 	for domain := range checked {
@@ -183,47 +218,53 @@ func FilterAndSubmit(domainMap map[string]struct{}, c *apiclient.Client, serverA
 	SubmitOutgoingDomains(c, toSubmit, serverAddr)
 }
 
-func CrawlURL(crawlerClient *apiclient.Client, targetURL string, debugMode bool, serverAddr string, robo RoboTesterInterface) { // nolint:funlen,gocognit
+// CrawlURL - crawl target until done, context is cancelled, max run time or memory limit is exceeded.
+func CrawlURL(ctx context.Context, cfg *config.Config, crawlerClient types.APIClientInterface, targetURL string, // nolint:funlen,gocognit
+	serverAddr string, robo RoboTesterInterface, reporter *progress.Reporter) error {
+	var mapLock sync.Mutex
+
 	domainMap := make(map[string]struct{})
 
 	if len(targetURL) == 0 {
-		panic("Cannot start with empty url")
+		return ErrEmptyURL
 	}
 
-	// Self-checks
-	mem := sigar.Mem{}
-	err := mem.Get()
-	//
+	// Self-checks, container limits apply
+	res, err := utils.GetResources()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if mem.Total < types.QuarterGig || mem.Free < types.QuarterGig {
-		panic(fmt.Sprintf("Will not start without enough RAM. At least %dM free is required", types.QuarterGig))
+	required := uint64(types.HalfGig)
+	if cfg.MemoryLimit/2 < required {
+		// crawler isn't allowed to use much more anyway, i.e. in its own cgroup
+		required = cfg.MemoryLimit / 2
 	}
 
-	if mem.Total < types.HalfGig || mem.Free < types.HalfGig {
-		panic("Will not start without enough RAM. At least 512M free is required")
+	if res.MemoryTotal < required || res.MemoryFree < required {
+		return fmt.Errorf("%w: at least %dM free is required", ErrNotEnoughRAM, required/types.OneMeg)
 	}
 	//
 	parsed, err := url.Parse(targetURL)
-	allowedDomain := strings.ToLower(parsed.Host)
+	if err != nil {
+		return err
+	}
 
+	scope, err := domain.NewScope(parsed.Host, domain.ScopePolicy(cfg.Scope))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Preserve incoming host for server queues without DB connection
-	domainMap[parsed.Host] = struct{}{}
-	done := make(chan bool)
+	domainMap[scope.Seed()] = struct{}{}
 
 	ua, err := crawlerClient.GetUA(fmt.Sprintf("http://%s/ua", serverAddr))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	filters := make([]*regexp.Regexp, 0, len(BannedExtensions))
-	for _, reg := range BannedExtensions {
+	filters := make([]*regexp.Regexp, 0, len(cfg.BannedExtensions))
+	for _, reg := range cfg.BannedExtensions {
 		filters = append(filters, regexp.MustCompile(fmt.Sprintf(`.+\.%s$`, reg)))
 	}
 
@@ -233,10 +274,19 @@ func CrawlURL(crawlerClient *apiclient.Client, targetURL string, debugMode bool,
 		colly.DisallowedURLFilters(filters...),
 	}
 
-	if debugMode {
+	if cfg.Debug {
 		defaultOptions = append(defaultOptions, colly.Debugger(&debug.LogDebugger{}))
 	}
 
+	// per-IP limits are shared with other crawlers through leader
+	limiter := connection.NewRemote(serverAddr)
+
+	robo.SetClient(&http.Client{Transport: connection.NewTransport(ippolicy.Default.Transport(), limiter)})
+
+	if len(cfg.RobotsAgents) > 0 {
+		robo.SetProducts(cfg.RobotsAgents)
+	}
+
 	robo.InitWithUA(ua)
 
 	log.Info("CrawlDelay: ", robo.GetDelay())
@@ -245,39 +295,103 @@ func CrawlURL(crawlerClient *apiclient.Client, targetURL string, debugMode bool,
 		defaultOptions...,
 	)
 
-	retryClient := apiclient.PrepareClient(crawlerClient.Logger)
+	ctx, cancel := context.WithTimeout(ctx, cfg.MaxRunTime)
+	defer cancel()
+
+	retryClient := apiclient.PrepareClient(crawlerClient.GetLogger())
+	// enforce IP policy at connect time, redirects to private networks included
+	// requests to the same host are paced by robots.txt delay plus jitter, before taking IP limiter token
+	scheduler := connection.NewScheduler(func(u *url.URL) time.Duration {
+		return robo.Delay(u.String())
+	}, cfg.RandomDelay)
+	// TLS details of responses are kept for landing report
+	tlsTransport := connection.NewTLSTransport(connection.NewPacedTransport(
+		connection.NewTransport(ippolicy.Default.Transport(), limiter), scheduler, cfg.Parallelism))
+	retryClient.HTTPClient.Transport = tlsTransport
+	land := newLanding(tlsTransport, reporter)
+	// requests in flight are aborted when crawl is over, they don't outlive it in in-process mode
+	crawlClient := retryClient.StandardClient()
+	crawlClient.Transport = connection.NewContextTransport(ctx, crawlClient.Transport)
+	crawlClient.Timeout = types.CrawlerRequestTimeout
 	// cfg
-	c.SetClient(retryClient.StandardClient())
-
-	_ = c.Limit(&colly.LimitRule{
-		Parallelism: types.Parallelism,
-		// Delay is the duration to wait before creating a new request to the matching domains
-		Delay: robo.GetDelay(),
-		// RandomDelay is the extra randomized duration to wait added to Delay before creating a new request
-		RandomDelay: types.RandomDelay,
+	c.SetClient(crawlClient)
+	// redirect targets are checked against robots.txt of their own host
+	c.SetRedirectHandler(func(req *http.Request, via []*http.Request) error {
+		if !robo.Test(req.URL.String()) {
+			reporter.RobotsDenied(req.URL.String())
+
+			return fmt.Errorf("%w: %s", ErrDisallowed, req.URL)
+		}
+		if len(via) >= MaxRedirects {
+			return http.ErrUseLastResponse
+		}
+
+		land.Redirect(via[0].URL.String(), req.URL.String())
+
+		return nil
 	})
 
+	// delays and parallel requests per host are handled by scheduler transport,
+	// colly limit rule would share one semaphore between all hosts
+	addExternal := func(host string) {
+		host, err := domain.Normalize(host)
+		if err != nil || host == scope.Seed() {
+			return
+		}
+
+		mapLock.Lock()
+		// external links
+		if _, ok := domainMap[host]; ok {
+			mapLock.Unlock()
+
+			return
+		}
+
+		var full map[string]struct{}
+		// full map is submitted outside of lock, callbacks keep adding to the new one meanwhile
+		if len(domainMap) >= cfg.MaxDomainsInMap {
+			full, domainMap = domainMap, make(map[string]struct{})
+		}
+
+		domainMap[host] = struct{}{}
+		mapLock.Unlock()
+
+		reporter.Discovered(host)
+
+		if full != nil {
+			FilterAndSubmit(cfg, full, crawlerClient, serverAddr, ua, reporter)
+		}
+	}
+
 	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
+		if ctx.Err() != nil {
+			return
+		}
+
 		link := e.Attr("href")
 		absolute := e.Request.AbsoluteURL(link)
 
 		parsed, err := url.Parse(absolute)
-		parsedHost := strings.ToLower(parsed.Host)
 		if err != nil {
-			print(err)
+			log.Error(err)
 
 			return
 		}
-		//
+
 		if !strings.HasPrefix(absolute, "http") {
 			return
 		}
+
+		parsedHost, err := domain.Normalize(parsed.Host)
+		if err != nil {
+			return
+		}
 		// No follow check
 		if strings.ToLower(e.Attr("rel")) == "nofollow" {
 			// check ignore map
 			ignore := false
-			for ending := range IgnoreNoFollow {
-				if strings.HasSuffix(parsedHost, ending) {
+			for _, ending := range cfg.IgnoreNoFollow {
+				if domain.IsSubdomain(parsedHost, ending) {
 					ignore = true
 
 					break
@@ -293,100 +407,151 @@ func CrawlURL(crawlerClient *apiclient.Client, targetURL string, debugMode bool,
 		}
 		//
 
-		if !strings.HasSuffix(parsedHost, allowedDomain) {
-			// external links
-			if len(domainMap) < types.MaxDomainsInMap {
-				if _, ok := domainMap[parsedHost]; !ok {
-					domainMap[parsedHost] = struct{}{}
-				}
+		// subdomains are reported as discoveries even when crawled as internal
+		if parsedHost != scope.Seed() {
+			addExternal(parsedHost)
+		}
 
+		if !scope.Contains(parsedHost) {
+			return
+		}
+
+		_ = c.Visit(absolute)
+	})
+
+	for _, extractor := range Extractors {
+		extractor.Register(c, func(host string) {
+			if ctx.Err() != nil {
 				return
 			}
-			//
-			FilterAndSubmit(domainMap, crawlerClient, serverAddr, ua)
-			//
-			domainMap = make(map[string]struct{})
+
+			addExternal(host)
+		})
+	}
+
+	c.OnResponse(func(r *colly.Response) {
+		land.Report(r)
+		reporter.Page(r.Request.URL.String(), r.StatusCode, int64(len(r.Body)))
+	})
+
+	// non-2xx responses end up here too
+	c.OnError(func(r *colly.Response, err error) {
+		land.Report(r)
+		reporter.Page(r.Request.URL.String(), r.StatusCode, int64(len(r.Body)))
+	})
+
+	c.OnRequest(func(r *colly.Request) {
+		if ctx.Err() != nil {
+			r.Abort()
 
 			return
 		}
 
-		if !robo.Test(link) {
-			log.Errorf("Crawling of %s is disallowed by robots.txt", absolute)
+		if !robo.Test(r.URL.String()) {
+			log.Errorf("Crawling of %s is disallowed by robots.txt", r.URL)
+			reporter.RobotsDenied(r.URL.String())
+			r.Abort()
 
 			return
 		}
 
-		// Apparently LimitRule has no effect on request delays so adding it manually here
-		time.Sleep(1*time.Second + robo.GetDelay())
-		_ = c.Visit(absolute)
-	})
-
-	c.OnRequest(func(r *colly.Request) {
-		if debugMode {
+		if cfg.Debug {
 			log.Println("Visiting", r.URL.String())
 		}
 	})
 
-	// catch SIGINT / SIGTERM / SIGQUIT signals & request exit
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-		<-sig
-		done <- true
-	}()
-
-	ts := time.Now()
 	ticker := time.NewTicker(types.TickEvery)
+	defer ticker.Stop()
+
+	var memoryExceeded int32
 
+	// in-process crawls share process memory, their limits are enforced by caller
 	go func() {
-		for t := range ticker.C {
-			mem := sigar.ProcMem{}
-			err := mem.Get(os.Getpid())
-			//
-			if err != nil {
-				// something's very wrong
-				log.Error(err)
-				done <- true
-
-				break
-			}
+		if cfg.InProcess {
+			return
+		}
 
-			log.Println("Tick at", t, mem.Resident/types.OneGig)
-			runtime.GC()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-ticker.C:
+				mem := sigar.ProcMem{}
+				err := mem.Get(os.Getpid())
+				//
+				if err != nil {
+					// something's very wrong
+					log.Error(err)
+					cancel()
 
-			if mem.Resident > types.TwoGigs {
-				// 2Gb MAX
-				log.Println("2Gb RAM limit exceeded, exiting...")
-				done <- true
+					return
+				}
 
-				break
-			}
+				log.Println("Tick at", t, mem.Resident/types.OneGig)
+				runtime.GC()
 
-			if t.After(ts.Add(types.CrawlerMaxRunTime)) {
-				log.Println("Max run time exceeded, exiting...")
-				done <- true
+				if mem.Resident > cfg.MemoryLimit {
+					log.Printf("%dM RAM limit exceeded, exiting...", cfg.MemoryLimit/types.OneMeg)
+					atomic.StoreInt32(&memoryExceeded, 1)
+					cancel()
 
-				break
+					return
+				}
 			}
 		}
 	}()
 
-	if !robo.Test("/") {
+	if !robo.Test(targetURL) {
 		log.Errorf("Crawling of / for %s is disallowed by robots.txt", targetURL)
+		reporter.RobotsDenied(targetURL)
 
-		return
+		return nil
 	}
 
+	finished := make(chan struct{})
+	sitemapsDone := make(chan struct{})
+	// Sitemaps often list cross-domain links that are not reachable through HTML
+	go func() {
+		// default location and robots.txt sitemaps of other hosts are subject to robots.txt too
+		walker := sitemap.NewWalker(crawlClient, ua, sitemap.DefaultLimits(), func(sitemapURL string) bool {
+			if robo.Test(sitemapURL) {
+				return true
+			}
+
+			reporter.RobotsDenied(sitemapURL)
+
+			return false
+		})
+		walker.Walk(ctx, sitemap.Candidates(targetURL, robo.GetSitemaps()), func(host string) {
+			addExternal(host)
+		})
+		close(sitemapsDone)
+	}()
 	// this one has to be started *AFTER* calling c.Visit()
 	go func() {
 		_ = c.Visit(targetURL)
 		c.Wait()
-		done <- true
+		<-sitemapsDone
+		close(finished)
 	}()
 
-	<-done
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Println("Max run time exceeded, exiting...")
+		}
+	}
 	// Submit remaining data
-	FilterAndSubmit(domainMap, crawlerClient, serverAddr, ua)
-	ticker.Stop()
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	FilterAndSubmit(cfg, domainMap, crawlerClient, serverAddr, ua, reporter)
 	log.Println("Crawler exit")
+
+	if atomic.LoadInt32(&memoryExceeded) == 1 {
+		return ErrMemoryLimit
+	}
+
+	return ctx.Err()
 }
@@ -0,0 +1,122 @@
+package crawlertools
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	sigar "github.com/cloudfoundry/gosigar"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+// Guarded - in-process crawl watched by Guard.
+type Guarded struct {
+	limit    uint64
+	cancel   context.CancelFunc
+	exceeded bool
+}
+
+// Guard - memory limits of crawlers running inside worker process. Memory can't be attributed to crawls,
+// so when process RSS exceeds the sum of their limits, the most recently started crawl is stopped.
+// Like Supervisor, it runs only while there are crawls to watch.
+type Guard struct {
+	lock    sync.Mutex
+	crawls  []*Guarded
+	running bool
+}
+
+func (g *Guard) check(resident uint64) {
+	var total uint64
+
+	for _, c := range g.crawls {
+		// stopped crawl holds its memory until it returns, wait for that
+		if c.exceeded {
+			return
+		}
+
+		total += c.limit
+	}
+
+	if resident <= total {
+		return
+	}
+
+	c := g.crawls[len(g.crawls)-1]
+	log.Printf("%dM RAM used by in-process crawlers > %dM allowed, stopping newest crawl",
+		resident/types.OneMeg, total/types.OneMeg)
+	c.exceeded = true
+	c.cancel()
+}
+
+func (g *Guard) run() {
+	ticker := time.NewTicker(types.TickEvery)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runtime.GC()
+
+		mem := sigar.ProcMem{}
+		if err := mem.Get(os.Getpid()); err != nil {
+			log.Error(err)
+		}
+
+		g.lock.Lock()
+
+		if len(g.crawls) == 0 {
+			g.running = false
+			g.lock.Unlock()
+
+			return
+		}
+
+		if mem.Resident > 0 {
+			g.check(mem.Resident)
+		}
+
+		g.lock.Unlock()
+	}
+}
+
+// Add - watch crawl with memory limit, cancel stops it.
+func (g *Guard) Add(limit uint64, cancel context.CancelFunc) *Guarded {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	c := &Guarded{limit: limit, cancel: cancel}
+	g.crawls = append(g.crawls, c)
+
+	if !g.running {
+		g.running = true
+
+		go g.run()
+	}
+
+	return c
+}
+
+// Remove - stop watching crawl, true when it was stopped for exceeding memory limit.
+func (g *Guard) Remove(c *Guarded) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for i, other := range g.crawls {
+		if other == c {
+			g.crawls = append(g.crawls[:i], g.crawls[i+1:]...)
+
+			break
+		}
+	}
+
+	return c.exceeded
+}
+
+func NewGuard() *Guard {
+	return &Guard{}
+}
+
+// DefaultGuard - watches in-process crawls of this worker.
+var DefaultGuard = NewGuard() // nolint:gochecknoglobals
@@ -0,0 +1,41 @@
+package crawlertools
+
+import (
+	"testing"
+)
+
+func TestGuardCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		resident uint64
+		want     []bool
+	}{
+		{"within limits", 300, []bool{false, false, false}},
+		{"over limits", 301, []bool{false, false, true}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGuard()
+			cancelled := make([]bool, 3)
+			crawls := make([]*Guarded, 0, 3)
+
+			for i := range cancelled {
+				i := i
+				g.crawls = append(g.crawls, &Guarded{limit: 100, cancel: func() { cancelled[i] = true }})
+				crawls = append(crawls, g.crawls[i])
+			}
+
+			g.check(tt.resident)
+			// stopped crawl still counts until it returns
+			g.check(tt.resident)
+
+			for i, c := range crawls {
+				if cancelled[i] != tt.want[i] || g.Remove(c) != tt.want[i] {
+					t.Errorf("crawl %d: cancelled %v, want %v", i, cancelled[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
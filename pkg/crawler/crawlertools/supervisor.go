@@ -0,0 +1,133 @@
+package crawlertools
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	sigar "github.com/cloudfoundry/gosigar"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+// SuperviseEvery - how often supervisor checks run time and memory of crawlers.
+const SuperviseEvery = time.Second
+
+// Exit - why supervisor stopped a crawler, if it did.
+type Exit struct {
+	MemoryExceeded bool
+	TimedOut       bool
+}
+
+type child struct {
+	pgid        int
+	deadline    time.Time
+	memoryLimit uint64
+	// killAt - SIGKILL time after SIGTERM was sent, zero when it wasn't
+	killAt time.Time
+	exit   Exit
+}
+
+// Supervisor - single goroutine enforcing run time and memory limits of crawler process groups.
+// It runs only while there are children to watch, so nothing is left behind when crawls finish.
+type Supervisor struct {
+	lock     sync.Mutex
+	children map[int]*child
+	running  bool
+}
+
+// terminate - SIGTERM to group now, SIGKILL after grace.
+func (c *child) terminate(now time.Time, grace time.Duration) {
+	if !c.killAt.IsZero() {
+		return
+	}
+
+	_ = syscall.Kill(-c.pgid, syscall.SIGTERM)
+	c.killAt = now.Add(grace)
+}
+
+func (s *Supervisor) check(now time.Time) {
+	for _, c := range s.children {
+		switch {
+		case !c.killAt.IsZero():
+			if now.After(c.killAt) {
+				_ = syscall.Kill(-c.pgid, syscall.SIGKILL)
+			}
+		case now.After(c.deadline):
+			log.Println("Run time exceeded, sending signal to ", c.pgid)
+			c.exit.TimedOut = true
+			c.terminate(now, types.CrawlerExtra)
+		default:
+			pm := sigar.ProcMem{}
+			if err := pm.Get(c.pgid); err != nil {
+				// exited, waiting for Remove
+				continue
+			}
+
+			log.Debugf("Parent tick for %d at %s: %v\n", c.pgid, now, pm.Resident/types.OneGig)
+
+			if pm.Resident > c.memoryLimit {
+				log.Debugf("Killing subprocess, memory used %d Kb > %d Kb memory allowed\n",
+					pm.Resident/types.OneK, c.memoryLimit/types.OneK)
+				c.exit.MemoryExceeded = true
+				c.terminate(now, types.KillSleep)
+			}
+		}
+	}
+}
+
+func (s *Supervisor) run() {
+	ticker := time.NewTicker(SuperviseEvery)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.lock.Lock()
+
+		if len(s.children) == 0 {
+			s.running = false
+			s.lock.Unlock()
+
+			return
+		}
+
+		s.check(now)
+		s.lock.Unlock()
+	}
+}
+
+// Add - watch process group led by pid.
+func (s *Supervisor) Add(pid int, maxRunTime time.Duration, memoryLimit uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.children[pid] = &child{pgid: pid, deadline: time.Now().Add(maxRunTime), memoryLimit: memoryLimit}
+
+	if !s.running {
+		s.running = true
+
+		go s.run()
+	}
+}
+
+// Remove - stop watching pid. Has to be called before process is reaped, so its PID isn't signalled after reuse.
+func (s *Supervisor) Remove(pid int) Exit {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.children[pid]
+	if !ok {
+		return Exit{}
+	}
+
+	delete(s.children, pid)
+
+	return c.exit
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{children: make(map[int]*child)}
+}
+
+// DefaultSupervisor - watches all crawler subprocesses of this worker.
+var DefaultSupervisor = NewSupervisor() // nolint:gochecknoglobals
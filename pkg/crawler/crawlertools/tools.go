@@ -3,69 +3,351 @@ package crawlertools
 import (
 	"bufio"
 	"context"
+	"errors"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 
+	"github.com/tb0hdan/idun/pkg/cgroup"
+	"github.com/tb0hdan/idun/pkg/config"
+	"github.com/tb0hdan/idun/pkg/control"
+	"github.com/tb0hdan/idun/pkg/crawler"
+	"github.com/tb0hdan/idun/pkg/crawler/progress"
+	"github.com/tb0hdan/idun/pkg/crawler/robots"
+	"github.com/tb0hdan/idun/pkg/domain"
+	"github.com/tb0hdan/idun/pkg/metrics"
 	"github.com/tb0hdan/idun/pkg/types"
-	"github.com/tb0hdan/idun/pkg/utils"
 )
 
-func RunCrawl(apiBase, target, serverAddr string, debugMode bool) {
-	// this will terminate process without chance to handle signal correctly
-	ctx, cancel := context.WithTimeout(context.Background(), types.CrawlerMaxRunTime+types.CrawlerExtra)
+// EnvStartFD - descriptor crawler subprocess waits on until worker has applied its limits.
+const EnvStartFD = "IDUN_START_FD"
 
-	defer cancel()
+// WaitStart - block until worker closes start pipe, no-op outside of crawler subprocess.
+func WaitStart() {
+	fd, err := strconv.Atoi(os.Getenv(EnvStartFD))
+	if err != nil || fd < 3 {
+		return
+	}
+
+	start := os.NewFile(uintptr(fd), "start")
+	_, _ = io.Copy(io.Discard, start)
+	start.Close()
+}
+
+// ExitOnCPULimit - Go runtime ignores SIGXCPU, report CPU limit and exit instead of being killed at hard limit.
+func ExitOnCPULimit(reporter *progress.Reporter) {
+	xcpu := make(chan os.Signal, 1)
+	signal.Notify(xcpu, syscall.SIGXCPU)
+
+	go func() {
+		<-xcpu
+		log.Error("CPU time limit exceeded, exiting...")
+		reporter.Exit(metrics.ExitCPULimit, nil)
+		os.Exit(types.ExitCodeCPULimit)
+	}()
+}
+
+// cpuLimit - RLIMIT_CPU soft limit of crawler subprocess.
+func cpuLimit(cfg *config.Config) time.Duration {
+	return cfg.MaxRunTime + types.CrawlerExtra
+}
+
+// setLimits - rlimits of crawler subprocess. Address space limit is a backstop for memory explosions
+// between supervisor polls, CPU limit for busy loops.
+func setLimits(pid int, cfg *config.Config) error {
+	cpuSeconds := uint64(cpuLimit(cfg).Seconds())
+	limits := map[int]*unix.Rlimit{
+		unix.RLIMIT_AS:     {Cur: cfg.MemoryLimit + types.ChildAddressSpaceReserve, Max: cfg.MemoryLimit + types.ChildAddressSpaceReserve},
+		unix.RLIMIT_NOFILE: {Cur: types.ChildMaxFiles, Max: types.ChildMaxFiles},
+		// SIGXCPU at soft limit, SIGKILL at hard one
+		unix.RLIMIT_CPU: {Cur: cpuSeconds, Max: cpuSeconds + uint64(types.KillSleep.Seconds())},
+	}
+
+	var result error
+
+	for resource, limit := range limits {
+		// only lower limits, raising hard ones needs privileges
+		current := &unix.Rlimit{}
+		if err := unix.Prlimit(pid, resource, nil, current); err == nil && current.Max < limit.Max {
+			limit.Max = current.Max
+		}
+
+		if limit.Cur > limit.Max {
+			limit.Cur = limit.Max
+		}
+
+		if err := unix.Prlimit(pid, resource, limit, nil); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// RunCrawl - crawl target in subprocess. Crawl receives subprocess PID, nil when run isn't tracked.
+// Subprocess runs with rlimits and, when cgroup v2 is delegated, in its own cgroup with memory and pids limits.
+// Result is built from progress events subprocess sends over inherited pipe.
+func RunCrawl(cfg *config.Config, target, serverAddr string, crawl *control.Crawl) *progress.Result {
+	result := progress.NewResult(target)
 
 	args := []string{
-		"-apiBase",
-		apiBase,
 		"-url",
 		target,
 		"-servers",
 		serverAddr,
 	}
 
-	if debugMode {
-		args = append(args, "-debug")
+	// child inherits effective config
+	env, err := cfg.Env()
+	if err != nil {
+		log.Error(err)
+		result.Reason, result.Error = metrics.ExitError, err.Error()
+
+		return result
+	}
+
+	events, eventsWriter, err := os.Pipe()
+	if err != nil {
+		log.Error(err)
+		result.Reason, result.Error = metrics.ExitError, err.Error()
+
+		return result
+	}
+	defer events.Close()
+
+	// subprocess waits until it is limited and in its cgroup
+	start, startWriter, err := os.Pipe()
+	if err != nil {
+		eventsWriter.Close()
+		log.Error(err)
+		result.Reason, result.Error = metrics.ExitError, err.Error()
+
+		return result
 	}
+	defer startWriter.Close()
+
+	var (
+		outOfMemory int32
+		group       *cgroup.Child
+	)
 
-	cmd := exec.CommandContext(ctx, os.Args[:1][0], args...) // nolint:gosec
+	started := time.Now()
+	cmd := exec.Command(os.Args[:1][0], args...) // nolint:gosec
+	// ExtraFiles start at fd 3 in subprocess
+	cmd.ExtraFiles = []*os.File{eventsWriter, start}
+	cmd.Env = append(env, progress.EnvFD+"=3", EnvStartFD+"=4")
+	// own process group, signals reach everything crawler started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	sout, _ := cmd.StdoutPipe()
 	serr, _ := cmd.StderrPipe()
-	err := cmd.Start()
+	err = cmd.Start()
+	// subprocess has its own copies
+	eventsWriter.Close()
+	start.Close()
 	//
 	if err != nil {
 		log.Error(err)
+		metrics.ObserveCrawlExit(metrics.ExitError, started)
+		result.Reason, result.Error = metrics.ExitError, err.Error()
 
-		return
+		return result
 	}
 
-	if cmd.Process != nil {
-		log.Debugf("PIDs: parent - %d, child - %d\n", os.Getpid(), cmd.Process.Pid)
+	pid := cmd.Process.Pid
+	log.Debugf("PIDs: parent - %d, child - %d\n", os.Getpid(), pid)
+	crawl.SetPID(pid)
 
-		// Monitor memory usage
-		go utils.PIDWatcher(cmd.Process.Pid)
+	if err := setLimits(pid, cfg); err != nil {
+		log.Errorf("Could not set limits of crawler %d: %+v", pid, err)
+	}
 
-		// Process is up, start countdown
-		go utils.WaitAndKill(types.CrawlerMaxRunTime, cmd.Process.Pid)
-		//
+	group, err = cgroup.NewChild(strconv.Itoa(pid), cfg.MemoryLimit, types.ChildMaxPids)
+	if err == nil {
+		if err = group.Add(pid); err != nil {
+			log.Errorf("Could not move crawler %d to cgroup: %+v", pid, err)
+		}
+	} else if !errors.Is(err, cgroup.ErrNotDelegated) {
+		log.Errorf("Could not create cgroup for crawler %d: %+v", pid, err)
 	}
 
-	pipes := io.MultiReader(sout, serr)
-	scanner := bufio.NewScanner(pipes)
-	//
-	for scanner.Scan() {
-		ucl := strings.ToUpper(scanner.Text())
-		log.Debugln(ucl)
+	// let subprocess go
+	startWriter.Close()
+
+	// run time and memory usage
+	DefaultSupervisor.Add(pid, cfg.MaxRunTime, cfg.MemoryLimit)
+
+	readers := &sync.WaitGroup{}
+	readers.Add(1)
+
+	go func() {
+		defer readers.Done()
+
+		if err := result.Read(events, observe); err != nil {
+			log.Errorf("Could not read progress of %s: %+v", target, err)
+		}
+	}()
+
+	for _, pipe := range []io.Reader{sout, serr} {
+		readers.Add(1)
+
+		go func(pipe io.Reader) {
+			defer readers.Done()
+
+			scanner := bufio.NewScanner(pipe)
+			for scanner.Scan() {
+				ucl := strings.ToUpper(scanner.Text())
+				log.Debugln(ucl)
+				// Go runtime dies this way on address space limit
+				if strings.Contains(ucl, "RUNTIME: OUT OF MEMORY") {
+					atomic.StoreInt32(&outOfMemory, 1)
+				}
+			}
+		}(pipe)
 	}
 
+	// wait for exit without reaping, PID can't be reused until supervisor and controller let it go
+	waitExited(pid)
+	exit := DefaultSupervisor.Remove(pid)
+	crawl.SetPID(0)
+
+	readers.Wait()
+
 	err = cmd.Wait()
 
 	if err != nil {
 		log.Debugf("Could not start crawler: %+v\n", err)
 	}
+
+	reason := exitReason(err, started, cfg.MaxRunTime, exit,
+		atomic.LoadInt32(&outOfMemory) == 1 || group.OOMKilled(), cpuLimited(err, cpuLimit(cfg)))
+	// subprocess knows better why it stopped on its own, i.e. memory limit
+	if (reason == metrics.ExitNormal || reason == metrics.ExitError) && result.Reason != "" {
+		reason = result.Reason
+	}
+
+	if reason != metrics.ExitNormal {
+		log.Printf("Crawler for %s exited: %s", target, reason)
+	}
+
+	if err := group.Remove(); err != nil {
+		log.Errorf("Could not remove crawler cgroup: %+v", err)
+	}
+
+	metrics.ObserveCrawlExit(reason, started)
+
+	result.Reason = reason
+	result.Duration = time.Since(started)
+
+	return result
+}
+
+// observe - record metrics of work done by crawler subprocess, only leader metrics are scraped.
+func observe(event progress.Event) {
+	switch event.Type {
+	case progress.EventFilter:
+		metrics.ObserveFilterDuration(event.Duration, len(event.Error) > 0)
+	case progress.EventHeadChecks:
+		metrics.HeadChecks.WithLabelValues(metrics.ResultPass).Add(float64(event.Passed))
+		metrics.HeadChecks.WithLabelValues(metrics.ResultFail).Add(float64(event.Failed))
+	case progress.EventSpool:
+		metrics.SpoolWritten.Add(float64(event.Passed))
+		metrics.SpoolDropped.Add(float64(event.Failed))
+	}
+}
+
+// waitExited - block until process exits, leaving it for cmd.Wait to reap.
+func waitExited(pid int) {
+	info := &unix.Siginfo{}
+
+	for {
+		err := unix.Waitid(unix.P_PID, pid, info, unix.WEXITED|unix.WNOWAIT, nil)
+		if !errors.Is(err, unix.EINTR) {
+			return
+		}
+	}
+}
+
+// cpuLimited - subprocess exited at RLIMIT_CPU soft limit, or was killed at hard one.
+func cpuLimited(err error, limit time.Duration) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+
+	if exitErr.ExitCode() == types.ExitCodeCPULimit {
+		return true
+	}
+
+	if !signaled(exitErr, syscall.SIGKILL) && !signaled(exitErr, syscall.SIGXCPU) {
+		return false
+	}
+
+	// rusage lags behind scheduler accounting the limit is enforced on
+	return exitErr.UserTime()+exitErr.SystemTime() >= limit-limit/10
+}
+
+func exitReason(err error, started time.Time, maxRunTime time.Duration, exit Exit, oomKilled, cpuLimited bool) string {
+	switch {
+	case oomKilled:
+		return metrics.ExitOOMKill
+	case exit.MemoryExceeded:
+		return metrics.ExitMemoryLimit
+	case cpuLimited:
+		return metrics.ExitCPULimit
+	case exit.TimedOut || time.Since(started) >= maxRunTime:
+		return metrics.ExitTimeout
+	case err != nil:
+		return metrics.ExitError
+	default:
+		return metrics.ExitNormal
+	}
+}
+
+func signaled(err *exec.ExitError, sig syscall.Signal) bool {
+	status, ok := err.Sys().(syscall.WaitStatus)
+
+	return ok && status.Signaled() && status.Signal() == sig
+}
+
+// RunCrawlInProcess - crawl target within current process. Avoids subprocess start at the cost of isolation.
+// Crawlers share process memory, DefaultGuard keeps it within the sum of their limits.
+func RunCrawlInProcess(ctx context.Context, cfg *config.Config, c types.APIClientInterface, target, serverAddr string) *progress.Result {
+	result := progress.NewResult(target)
+	target = domain.ToURL(target)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	guarded := DefaultGuard.Add(cfg.MemoryLimit, cancel)
+	err := crawler.CrawlURL(ctx, cfg, c, target, serverAddr, robots.NewRoboTester(target), progress.NewLocal(result))
+
+	if DefaultGuard.Remove(guarded) {
+		err = crawler.ErrMemoryLimit
+	}
+
+	if err != nil {
+		log.Debugf("Crawl of %s finished with: %+v\n", target, err)
+	}
+
+	reason := crawler.ExitReason(err)
+	metrics.ObserveCrawlExit(reason, result.Started)
+
+	result.Reason = reason
+	result.Duration = time.Since(result.Started)
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
 }
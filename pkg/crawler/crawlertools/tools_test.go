@@ -0,0 +1,34 @@
+package crawlertools
+
+import (
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+func TestCPULimited(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   bool
+	}{
+		{"normal exit", "exit 0", false},
+		{"error exit", "exit 1", false},
+		{"exit after SIGXCPU", "exit " + strconv.Itoa(types.ExitCodeCPULimit), true},
+		{"killed without CPU use", "kill -KILL $$", false},
+		{"CPU time exceeded", "ulimit -t 1; while :; do :; done", true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := exec.Command("sh", "-c", tt.script).Run()
+			if got := cpuLimited(err, time.Second); got != tt.want {
+				t.Errorf("cpuLimited(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package extractors
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// Sink - receives hosts referenced by crawled page. These are reported, never followed.
+type Sink func(host string)
+
+type Extractor interface {
+	Name() string
+	Register(c *colly.Collector, sink Sink)
+}
+
+var metaRefreshURL = regexp.MustCompile(`(?i)url\s*=\s*['"]?([^'"\s]+)`) // nolint:gochecknoglobals
+
+// hostOf - resolve raw reference against request URL and return its host for http(s) links only.
+func hostOf(req *colly.Request, raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) == 0 {
+		return ""
+	}
+
+	parsed, err := url.Parse(req.AbsoluteURL(raw))
+	if err != nil {
+		return ""
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return ""
+	}
+
+	return strings.ToLower(parsed.Host)
+}
+
+func report(sink Sink, host string) {
+	if len(host) > 0 {
+		sink(host)
+	}
+}
+
+// AttrExtractor - host from a single URL valued attribute.
+type AttrExtractor struct {
+	Selector string
+	Attr     string
+}
+
+func (a *AttrExtractor) Name() string {
+	return a.Selector
+}
+
+func (a *AttrExtractor) Register(c *colly.Collector, sink Sink) {
+	c.OnHTML(a.Selector, func(e *colly.HTMLElement) {
+		report(sink, hostOf(e.Request, e.Attr(a.Attr)))
+	})
+}
+
+// SrcsetExtractor - hosts from srcset candidate lists, i.e. "a.jpg 1x, //cdn.example.com/b.jpg 2x".
+type SrcsetExtractor struct {
+	Selector string
+}
+
+func (s *SrcsetExtractor) Name() string {
+	return s.Selector
+}
+
+func (s *SrcsetExtractor) Register(c *colly.Collector, sink Sink) {
+	c.OnHTML(s.Selector, func(e *colly.HTMLElement) {
+		for _, candidate := range strings.Split(e.Attr("srcset"), ",") {
+			fields := strings.Fields(candidate)
+			if len(fields) == 0 {
+				continue
+			}
+
+			report(sink, hostOf(e.Request, fields[0]))
+		}
+	})
+}
+
+// MetaRefreshExtractor - host from <meta http-equiv="refresh" content="0; url=...">.
+type MetaRefreshExtractor struct{}
+
+func (m *MetaRefreshExtractor) Name() string {
+	return "meta refresh"
+}
+
+func (m *MetaRefreshExtractor) Register(c *colly.Collector, sink Sink) {
+	c.OnHTML("meta[http-equiv]", func(e *colly.HTMLElement) {
+		if !strings.EqualFold(e.Attr("http-equiv"), "refresh") {
+			return
+		}
+
+		match := metaRefreshURL.FindStringSubmatch(e.Attr("content"))
+		if len(match) < 2 {
+			return
+		}
+
+		report(sink, hostOf(e.Request, match[1]))
+	})
+}
+
+// HeaderExtractor - hosts from Content-Security-Policy and Link response headers.
+type HeaderExtractor struct{}
+
+func (h *HeaderExtractor) Name() string {
+	return "headers"
+}
+
+func (h *HeaderExtractor) Register(c *colly.Collector, sink Sink) {
+	c.OnResponseHeaders(func(r *colly.Response) {
+		for _, policy := range r.Headers.Values("Content-Security-Policy") {
+			for _, host := range CSPHosts(policy) {
+				report(sink, host)
+			}
+		}
+
+		for _, link := range r.Headers.Values("Link") {
+			for _, target := range LinkTargets(link) {
+				report(sink, hostOf(r.Request, target))
+			}
+		}
+	})
+}
+
+// CSPHosts - host sources from CSP policy. Keywords, scheme sources, nonces and hashes are skipped.
+func CSPHosts(policy string) []string {
+	hosts := make([]string, 0)
+
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		// first field is directive name
+		for idx := 1; idx < len(fields); idx++ {
+			source := strings.ToLower(fields[idx])
+			if strings.HasPrefix(source, "'") || strings.HasSuffix(source, ":") || source == "*" {
+				continue
+			}
+
+			if pos := strings.Index(source, "://"); pos >= 0 {
+				source = source[pos+3:]
+			}
+
+			if pos := strings.IndexAny(source, "/:"); pos >= 0 {
+				source = source[:pos]
+			}
+
+			source = strings.TrimPrefix(source, "*.")
+			if len(source) == 0 || !strings.Contains(source, ".") {
+				continue
+			}
+
+			hosts = append(hosts, source)
+		}
+	}
+
+	return hosts
+}
+
+// LinkTargets - URI references from RFC 8288 Link header. Links are read in order, so commas
+// inside <...> and quoted parameters don't split them.
+func LinkTargets(header string) []string {
+	targets := make([]string, 0)
+
+	for rest := header; ; {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			return targets
+		}
+
+		end := strings.IndexByte(rest[start:], '>')
+		if end < 0 {
+			return targets
+		}
+
+		if target := strings.TrimSpace(rest[start+1 : start+end]); len(target) > 0 {
+			targets = append(targets, target)
+		}
+		// skip parameters up to next link
+		rest = rest[start+end+1:]
+
+		next := linkSeparator(rest)
+		if next < 0 {
+			return targets
+		}
+
+		rest = rest[next+1:]
+	}
+}
+
+// linkSeparator - position of comma ending link parameters, -1 when it's the last link.
+func linkSeparator(params string) int {
+	quoted := false
+
+	for idx := 0; idx < len(params); idx++ {
+		switch params[idx] {
+		case '\\':
+			// quoted-pair
+			if quoted {
+				idx++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				return idx
+			}
+		}
+	}
+
+	return -1
+}
+
+// Default - all extractors shipped with idun.
+func Default() []Extractor {
+	return []Extractor{
+		&AttrExtractor{Selector: "link[href]", Attr: "href"},
+		&AttrExtractor{Selector: "script[src]", Attr: "src"},
+		&AttrExtractor{Selector: "img[src]", Attr: "src"},
+		&AttrExtractor{Selector: "iframe[src]", Attr: "src"},
+		&AttrExtractor{Selector: "form[action]", Attr: "action"},
+		&SrcsetExtractor{Selector: "img[srcset]"},
+		&SrcsetExtractor{Selector: "source[srcset]"},
+		&MetaRefreshExtractor{},
+		&HeaderExtractor{},
+	}
+}
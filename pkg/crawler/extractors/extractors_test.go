@@ -0,0 +1,85 @@
+package extractors
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCSPHosts(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   []string
+	}{
+		{
+			name:   "host sources",
+			policy: "default-src 'self'; script-src https://cdn.example.com/js/ *.static.example.org:443",
+			want:   []string{"cdn.example.com", "static.example.org"},
+		},
+		{
+			name:   "keywords, schemes, nonces and hashes",
+			policy: "script-src 'unsafe-inline' 'nonce-abc' 'sha256-xyz' https: data: blob: *",
+			want:   []string{},
+		},
+		{
+			name:   "bare host and port wildcard",
+			policy: "img-src Images.Example.NET:*; connect-src wss://ws.example.io",
+			want:   []string{"images.example.net", "ws.example.io"},
+		},
+		{
+			name:   "directive name only and hosts without dots",
+			policy: "upgrade-insecure-requests; frame-src localhost",
+			want:   []string{},
+		},
+		{name: "empty", policy: "", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := CSPHosts(tt.policy); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: CSPHosts() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLinkTargets(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []string
+	}{
+		{
+			name:   "single",
+			header: `<https://example.com/style.css>; rel=preload; as=style`,
+			want:   []string{"https://example.com/style.css"},
+		},
+		{
+			name:   "several",
+			header: `<https://a.example.com/>; rel=preconnect, </relative>; rel="next"`,
+			want:   []string{"https://a.example.com/", "/relative"},
+		},
+		{
+			name:   "comma in URI",
+			header: `<https://fonts.example.com/css?family=A,B>; rel=preload, <https://b.example.com/>`,
+			want:   []string{"https://fonts.example.com/css?family=A,B", "https://b.example.com/"},
+		},
+		{
+			name:   "comma and brackets in quoted parameter",
+			header: `<https://a.example.com/>; title="one, <two>", <https://b.example.com/>`,
+			want:   []string{"https://a.example.com/", "https://b.example.com/"},
+		},
+		{
+			name:   "escaped quote in parameter",
+			header: `<https://a.example.com/>; title="say \", <x>", <https://b.example.com/>`,
+			want:   []string{"https://a.example.com/", "https://b.example.com/"},
+		},
+		{name: "empty target", header: `<>; rel=self, <https://b.example.com/>`, want: []string{"https://b.example.com/"}},
+		{name: "unterminated", header: `<https://a.example.com/`, want: []string{}},
+		{name: "empty", header: "", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := LinkTargets(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: LinkTargets() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
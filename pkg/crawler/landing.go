@@ -0,0 +1,68 @@
+package crawler
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/gocolly/colly/v2"
+
+	"github.com/tb0hdan/idun/pkg/crawler/connection"
+	"github.com/tb0hdan/idun/pkg/crawler/progress"
+)
+
+// landing - reports where seed request ended up. colly updates request URL after redirects
+// for successful responses only, so redirect targets are tracked until the report is sent.
+type landing struct {
+	lock      sync.Mutex
+	reported  bool
+	redirects map[string]string
+	tls       *connection.TLSTransport
+	reporter  *progress.Reporter
+}
+
+// Redirect - request for from was redirected to to.
+func (l *landing) Redirect(from, to string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.reported {
+		return
+	}
+
+	l.redirects[from] = to
+}
+
+// Report - send landing of the first finished request, seed is requested first.
+func (l *landing) Report(r *colly.Response) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.reported {
+		return
+	}
+
+	l.reported = true
+
+	final := r.Request.URL.String()
+	if to, ok := l.redirects[final]; ok {
+		final = to
+	}
+
+	l.redirects = nil
+
+	server := ""
+	if r.Headers != nil {
+		server = r.Headers.Get("Server")
+	}
+
+	info := connection.TLSInfo{}
+	if parsed, err := url.Parse(final); err == nil {
+		info, _ = l.tls.Get(parsed.Host)
+	}
+
+	l.reporter.Landing(final, r.StatusCode, server, info.Version, info.Issuer)
+}
+
+func newLanding(tls *connection.TLSTransport, reporter *progress.Reporter) *landing {
+	return &landing{redirects: make(map[string]string), tls: tls, reporter: reporter}
+}
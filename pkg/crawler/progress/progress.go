@@ -0,0 +1,219 @@
+package progress
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// EnvFD - descriptor of progress pipe inherited by crawler subprocess.
+	EnvFD = "IDUN_PROGRESS_FD"
+	// event types.
+	EventPage         = "page"
+	EventDiscovered   = "discovered"
+	EventRobotsDenied = "robots_denied"
+	EventLanding      = "landing"
+	EventFilter       = "filter"
+	EventHeadChecks   = "head_checks"
+	EventSpool        = "spool"
+	EventExit         = "exit"
+	// maxLine - events are small, anything longer is garbage.
+	maxLine = 1 << 20
+)
+
+// Event - one JSON line sent by crawler.
+type Event struct {
+	Type string `json:"type"`
+	URL  string `json:"url,omitempty"`
+	// Status - HTTP status of page, 0 when request failed without response
+	Status int      `json:"status,omitempty"`
+	Bytes  int64    `json:"bytes,omitempty"`
+	Hosts  []string `json:"hosts,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	// Server, TLSVersion, TLSIssuer - landing details
+	Server     string `json:"server,omitempty"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	TLSIssuer  string `json:"tls_issuer,omitempty"`
+	// Duration - filter call latency
+	Duration time.Duration `json:"duration,omitempty"`
+	// Passed, Failed - head check results, or domains spooled and dropped because spool was full
+	Passed int `json:"passed,omitempty"`
+	Failed int `json:"failed,omitempty"`
+}
+
+// Result - crawl summary built from events.
+type Result struct {
+	Domain string `json:"domain"`
+	// FinalURL - seed URL after redirects
+	FinalURL string `json:"final_url"`
+	// Status - HTTP status of seed, 0 when it got no response
+	Status int    `json:"status"`
+	Server string `json:"server"`
+	// TLSVersion, TLSIssuer - empty for plain HTTP
+	TLSVersion string `json:"tls_version"`
+	TLSIssuer  string `json:"tls_issuer"`
+	// Pages - responses received, any status
+	Pages int   `json:"pages"`
+	Bytes int64 `json:"bytes"`
+	// Failed - requests that got no response
+	Failed       int           `json:"failed"`
+	Statuses     map[int]int   `json:"statuses"`
+	Discovered   int           `json:"discovered"`
+	RobotsDenied int           `json:"robots_denied"`
+	Reason       string        `json:"reason"`
+	Error        string        `json:"error,omitempty"`
+	Started      time.Time     `json:"started"`
+	Duration     time.Duration `json:"duration"`
+}
+
+// Apply - add event to summary.
+func (r *Result) Apply(event Event) {
+	switch event.Type {
+	case EventPage:
+		if event.Status == 0 {
+			r.Failed++
+
+			return
+		}
+
+		r.Pages++
+		r.Bytes += event.Bytes
+		r.Statuses[event.Status]++
+	case EventDiscovered:
+		r.Discovered += len(event.Hosts)
+	case EventRobotsDenied:
+		r.RobotsDenied++
+	case EventLanding:
+		r.FinalURL = event.URL
+		r.Status = event.Status
+		r.Server = event.Server
+		r.TLSVersion = event.TLSVersion
+		r.TLSIssuer = event.TLSIssuer
+	case EventExit:
+		r.Reason = event.Reason
+		r.Error = event.Error
+	}
+}
+
+// Read - apply events from reader until it is closed. Malformed lines are skipped.
+// Events are also passed to forward, if set, i.e. to record subprocess metrics.
+func (r *Result) Read(reader io.Reader, forward func(event Event)) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLine)
+
+	for scanner.Scan() {
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+
+		r.Apply(event)
+
+		if forward != nil {
+			forward(event)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func NewResult(domain string) *Result {
+	return &Result{Domain: domain, Statuses: make(map[int]int), Started: time.Now()}
+}
+
+// Reporter - sends crawl progress events, safe for concurrent use. Nil Reporter discards them.
+type Reporter struct {
+	lock sync.Mutex
+	sink func(event Event)
+}
+
+func (r *Reporter) send(event Event) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.sink(event)
+}
+
+// Page - page fetched, status 0 when there was no response.
+func (r *Reporter) Page(url string, status int, bytes int64) {
+	r.send(Event{Type: EventPage, URL: url, Status: status, Bytes: bytes})
+}
+
+// Discovered - new hosts found.
+func (r *Reporter) Discovered(hosts ...string) {
+	r.send(Event{Type: EventDiscovered, Hosts: hosts})
+}
+
+// RobotsDenied - request not sent because of robots.txt.
+func (r *Reporter) RobotsDenied(url string) {
+	r.send(Event{Type: EventRobotsDenied, URL: url})
+}
+
+// Landing - seed request finished, url is the one after redirects. Status is 0 when there was no response.
+func (r *Reporter) Landing(url string, status int, server, tlsVersion, tlsIssuer string) {
+	r.send(Event{Type: EventLanding, URL: url, Status: status, Server: server, TLSVersion: tlsVersion, TLSIssuer: tlsIssuer})
+}
+
+// Filter - FilterDomains call finished.
+func (r *Reporter) Filter(duration time.Duration, err error) {
+	event := Event{Type: EventFilter, Duration: duration}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	r.send(event)
+}
+
+// HeadChecks - HEAD checks of discovered domains finished.
+func (r *Reporter) HeadChecks(passed, failed int) {
+	r.send(Event{Type: EventHeadChecks, Passed: passed, Failed: failed})
+}
+
+// Spool - domains of failed filter request spooled or dropped.
+func (r *Reporter) Spool(written, dropped int) {
+	r.send(Event{Type: EventSpool, Passed: written, Failed: dropped})
+}
+
+// Exit - crawl finished, reason is one of metrics.Exit* values.
+func (r *Reporter) Exit(reason string, err error) {
+	event := Event{Type: EventExit, Reason: reason}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	r.send(event)
+}
+
+// NewWriter - reporter writing JSON lines to writer.
+func NewWriter(writer io.Writer) *Reporter {
+	encoder := json.NewEncoder(writer)
+
+	return &Reporter{sink: func(event Event) {
+		_ = encoder.Encode(event)
+	}}
+}
+
+// NewLocal - reporter applying events to result directly, for in-process crawls.
+func NewLocal(result *Result) *Reporter {
+	return &Reporter{sink: result.Apply}
+}
+
+// FromEnv - reporter on pipe inherited from worker, nil when there is none.
+func FromEnv() *Reporter {
+	fd, err := strconv.Atoi(os.Getenv(EnvFD))
+	if err != nil || fd < 3 {
+		return nil
+	}
+
+	return NewWriter(os.NewFile(uintptr(fd), "progress"))
+}
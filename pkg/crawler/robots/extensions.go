@@ -0,0 +1,309 @@
+package robots
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/temoto/robotstxt"
+)
+
+const minutesPerDay = 24 * 60
+
+// genericProducts - User-Agent products that don't identify a crawler.
+var genericProducts = map[string]struct{}{ // nolint:gochecknoglobals
+	"mozilla": {}, "applewebkit": {}, "khtml": {}, "like gecko": {}, "gecko": {}, "chrome": {},
+	"safari": {}, "firefox": {}, "version": {}, "mobile": {}, "compatible": {},
+}
+
+// window - UTC time of day range in minutes, may wrap over midnight.
+type window struct {
+	start, end int
+}
+
+func (w window) contains(now time.Time) bool {
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+
+	return minute >= w.start || minute < w.end
+}
+
+// rate - Request-rate, one request per interval, optionally only within window.
+type rate struct {
+	interval time.Duration
+	window   *window
+}
+
+// extension - non-standard group members not handled by robotstxt.
+type extension struct {
+	rates  []rate
+	visits []window
+}
+
+// Rules - parsed robots.txt of one origin.
+type Rules struct {
+	*robotstxt.RobotsData
+	extensions map[string]*extension
+}
+
+// find - extension group for agent, matched the same way as robotstxt.FindGroup.
+func (r *Rules) find(agent string) *extension {
+	var (
+		ret       *extension
+		prefixLen int
+	)
+
+	agent = strings.ToLower(agent)
+	if ret = r.extensions["*"]; ret != nil {
+		prefixLen = 1
+	}
+
+	for a, ext := range r.extensions {
+		if a != "*" && strings.HasPrefix(agent, a) && len(a) > prefixLen {
+			prefixLen = len(a)
+			ret = ext
+		}
+	}
+
+	return ret
+}
+
+// Delay - wait between requests for agent: the longest of Crawl-delay and Request-rate active now.
+func (r *Rules) Delay(agent string, now time.Time) time.Duration {
+	delay := r.FindGroup(agent).CrawlDelay
+
+	ext := r.find(agent)
+	if ext == nil {
+		return delay
+	}
+
+	for _, rt := range ext.rates {
+		if rt.window != nil && !rt.window.contains(now) {
+			continue
+		}
+
+		if rt.interval > delay {
+			delay = rt.interval
+		}
+	}
+
+	return delay
+}
+
+// VisitAllowed - whether agent may crawl now according to Visit-time.
+func (r *Rules) VisitAllowed(agent string, now time.Time) bool {
+	ext := r.find(agent)
+	if ext == nil || len(ext.visits) == 0 {
+		return true
+	}
+
+	for _, visit := range ext.visits {
+		if visit.contains(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseWindow - HHMM-HHMM, i.e. 0600-0845.
+func parseWindow(value string) (*window, bool) {
+	start, end, ok := strings.Cut(strings.ReplaceAll(value, ":", ""), "-")
+	if !ok {
+		return nil, false
+	}
+
+	parse := func(hhmm string) (int, bool) {
+		hhmm = strings.TrimSpace(hhmm)
+		if len(hhmm) != 4 {
+			return 0, false
+		}
+
+		hours, err1 := strconv.Atoi(hhmm[:2])
+		minutes, err2 := strconv.Atoi(hhmm[2:])
+
+		if err1 != nil || err2 != nil || hours > 24 || minutes > 59 {
+			return 0, false
+		}
+
+		return (hours*60 + minutes) % minutesPerDay, true
+	}
+
+	from, ok1 := parse(start)
+	to, ok2 := parse(end)
+
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+
+	return &window{start: from, end: to}, true
+}
+
+// parseRate - requests/period[s|m|h] with optional window, i.e. 1/5s or 1/10m 0600-0845.
+func parseRate(value string) (rate, bool) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return rate{}, false
+	}
+
+	count, period, ok := strings.Cut(fields[0], "/")
+	if !ok {
+		return rate{}, false
+	}
+
+	requests, err := strconv.Atoi(count)
+	if err != nil || requests <= 0 {
+		return rate{}, false
+	}
+
+	unit := time.Second
+
+	switch {
+	case strings.HasSuffix(period, "s"):
+		period = strings.TrimSuffix(period, "s")
+	case strings.HasSuffix(period, "m"):
+		period, unit = strings.TrimSuffix(period, "m"), time.Minute
+	case strings.HasSuffix(period, "h"):
+		period, unit = strings.TrimSuffix(period, "h"), time.Hour
+	}
+
+	length, err := strconv.Atoi(period)
+	if err != nil || length <= 0 {
+		return rate{}, false
+	}
+
+	parsed := rate{interval: time.Duration(length) * unit / time.Duration(requests)}
+
+	if len(fields) > 1 {
+		if w, ok := parseWindow(fields[1]); ok {
+			parsed.window = w
+		}
+	}
+
+	return parsed, true
+}
+
+// parseExtensions - Request-rate and Visit-time per lower-cased user-agent.
+func parseExtensions(body []byte) map[string]*extension {
+	extensions := make(map[string]*extension)
+
+	var (
+		current    *extension
+		agentsLine bool
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			// consecutive user-agent lines share a group
+			if !agentsLine || current == nil {
+				current = &extension{}
+			}
+
+			agentsLine = true
+			extensions[strings.ToLower(value)] = current
+
+			continue
+		}
+
+		agentsLine = false
+
+		if current == nil {
+			continue
+		}
+
+		switch key {
+		case "request-rate":
+			if parsed, ok := parseRate(value); ok {
+				current.rates = append(current.rates, parsed)
+			}
+		case "visit-time":
+			if parsed, ok := parseWindow(value); ok {
+				current.visits = append(current.visits, *parsed)
+			}
+		}
+	}
+
+	return extensions
+}
+
+// Products - robots.txt product tokens from User-Agent: its leading product and bot products of
+// "compatible" comment, i.e. "Mozilla/5.0 (compatible; Domains Project/1.0; +https://domainsproject.org)"
+// gives "Domains Project" and "domainsproject.org". Generic browser products and platform
+// comments like "X11; Linux x86_64" are skipped.
+func Products(userAgent string) []string {
+	products := make([]string, 0)
+	seen := make(map[string]struct{})
+
+	add := func(token string) {
+		token, _, _ = strings.Cut(strings.TrimSpace(token), "/")
+		token = strings.TrimSpace(token)
+
+		if token == "" {
+			return
+		}
+
+		lower := strings.ToLower(token)
+		if _, ok := genericProducts[lower]; ok {
+			return
+		}
+
+		if _, ok := seen[lower]; ok {
+			return
+		}
+
+		seen[lower] = struct{}{}
+		products = append(products, token)
+	}
+
+	before, comment, found := strings.Cut(userAgent, "(")
+	if leading := strings.Fields(before); len(leading) > 0 {
+		add(leading[0])
+	}
+
+	for found {
+		comment, userAgent, _ = strings.Cut(comment, ")")
+		parts := strings.Split(comment, ";")
+
+		if strings.EqualFold(strings.TrimSpace(parts[0]), "compatible") {
+			for _, part := range parts[1:] {
+				part = strings.TrimPrefix(strings.TrimSpace(part), "+")
+
+				switch {
+				// bot home page, only bare hosts name the bot
+				case strings.Contains(part, "://"):
+					_, address, _ := strings.Cut(part, "://")
+					if host, path, _ := strings.Cut(address, "/"); path == "" {
+						add(host)
+					}
+				// bot product, i.e. FooBot/1.0
+				case strings.Contains(part, "/"):
+					add(part)
+				}
+			}
+		}
+
+		_, comment, found = strings.Cut(userAgent, "(")
+	}
+
+	return products
+}
@@ -0,0 +1,127 @@
+package robots
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/temoto/robotstxt"
+)
+
+func TestProducts(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want []string
+	}{
+		{
+			name: "compatible bot",
+			ua:   "Mozilla/5.0 (compatible; Domains Project/1.0; +https://domainsproject.org)",
+			want: []string{"Domains Project", "domainsproject.org"},
+		},
+		{
+			name: "bot info page is not a product",
+			ua:   "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want: []string{"Googlebot"},
+		},
+		{
+			name: "leading product",
+			ua:   "FooBot/1.0 (+https://foo.example; Linux x86_64) libfoo/2.0",
+			want: []string{"FooBot"},
+		},
+		{
+			name: "browser",
+			ua:   "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36",
+			want: []string{},
+		},
+		{
+			name: "compatible browser",
+			ua:   "Mozilla/5.0 (compatible; MSIE 9.0; Windows NT 6.1; Trident/5.0)",
+			want: []string{"Trident"},
+		},
+		{
+			name: "compatible comment after platform",
+			ua:   "Mozilla/5.0 (Linux; Android 6.0.1) (compatible; BarBot/3.1)",
+			want: []string{"BarBot"},
+		},
+		{name: "empty", ua: "", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := Products(tt.ua); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Products() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	body := []byte(`User-agent: *
+Crawl-delay: 2
+Request-rate: 1/10s 0000-1200 # mornings
+Request-rate: 3/15s
+
+User-agent: FooBot
+User-agent: BarBot
+Request-rate: 1/1h
+Visit-time: 2200-0600
+
+User-agent: BazBot
+Request-rate: garbage
+Visit-time: 25:00-2600
+`)
+
+	robots, err := robotstxt.FromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := &Rules{RobotsData: robots, extensions: parseExtensions(body)}
+	morning := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	evening := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		agent   string
+		now     time.Time
+		delay   time.Duration
+		allowed bool
+	}{
+		{"OtherBot", morning, 10 * time.Second, true},
+		{"OtherBot", evening, 5 * time.Second, true},
+		{"FooBot", morning, time.Hour, false},
+		{"barbot", evening, time.Hour, true},
+		// group without rules, robotstxt falls back to * for Crawl-delay
+		{"BazBot", morning, 2 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		if delay := rules.Delay(tt.agent, tt.now); delay != tt.delay {
+			t.Errorf("Delay(%s, %s) = %s, want %s", tt.agent, tt.now.Format("15:04"), delay, tt.delay)
+		}
+
+		if allowed := rules.VisitAllowed(tt.agent, tt.now); allowed != tt.allowed {
+			t.Errorf("VisitAllowed(%s, %s) = %v, want %v", tt.agent, tt.now.Format("15:04"), allowed, tt.allowed)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		value string
+		want  *window
+	}{
+		{"0600-0845", &window{start: 360, end: 525}},
+		{"06:00-08:45", &window{start: 360, end: 525}},
+		{"2300-0100", &window{start: 1380, end: 60}},
+		{"2400-0100", &window{start: 0, end: 60}},
+		{"600-0845", nil},
+		{"0660-0845", nil},
+		{"0600", nil},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseWindow(tt.value)
+		if ok != (tt.want != nil) || (ok && *got != *tt.want) {
+			t.Errorf("parseWindow(%s) = %+v, %v, want %+v", tt.value, got, ok, tt.want)
+		}
+	}
+}
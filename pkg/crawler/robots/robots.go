@@ -2,9 +2,14 @@ package robots
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/temoto/robotstxt"
@@ -12,77 +17,303 @@ import (
 
 const (
 	RobotsTimeout = 10 * time.Second
+	// RobotsTTL - RFC 9309 asks not to use cached robots.txt for more than 24 hours.
+	RobotsTTL = 24 * time.Hour
+	// RobotsCooldown - host with unreachable robots.txt or 5xx is fully disallowed for this long, then retried.
+	RobotsCooldown = 10 * time.Minute
+	// MaxRedirects - RFC 9309 asks to follow at least five.
+	MaxRedirects = 5
+	// MaxSize - RFC 9309 asks to parse at least 500 KiB.
+	MaxSize = 500 * 1024
 )
 
-type RoboTester struct {
-	robots    *robotstxt.RobotsData
+var ErrTooManyRedirects = errors.New("too many robots.txt redirects") // nolint:gochecknoglobals
+
+type entry struct {
+	ready   chan struct{}
+	rules   *Rules
+	expires time.Time
+}
+
+// Cache - robots.txt per scheme, host and port, safe for concurrent use.
+// Concurrent lookups of the same origin share one fetch.
+type Cache struct {
+	lock      sync.Mutex
+	entries   map[string]*entry
+	client    *http.Client
 	userAgent string
-	fullURL   string
-	gotRobots bool
 }
 
-func (rt *RoboTester) GetRobots(path string) (robots *robotstxt.RobotsData, err error) {
-	parsed, err := url.Parse(path)
-	if err != nil {
-		return &robotstxt.RobotsData{}, err
+// Origin - scheme://host:port of URL, default port made explicit.
+func Origin(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+
+	if port == "" {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
 	}
 
-	robotsURL := fmt.Sprintf("%s://%s/robots.txt", parsed.Scheme, parsed.Host)
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(strings.ToLower(u.Hostname()), port))
+}
 
-	client := &http.Client{}
+// fetch - robots.txt of origin and how long to keep it.
+func (c *Cache) fetch(origin string) (*Rules, time.Duration) {
+	// unreachable or server error - assume complete disallow
+	disallowAll := &Rules{}
+	disallowAll.RobotsData, _ = robotstxt.FromStatusAndBytes(http.StatusInternalServerError, nil)
+	// unavailable - no restrictions
+	allowAll := &Rules{}
+	allowAll.RobotsData, _ = robotstxt.FromStatusAndBytes(http.StatusNotFound, nil)
 
 	ctx, cancel := context.WithTimeout(context.Background(), RobotsTimeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", robotsURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
 	if err != nil {
-		return &robotstxt.RobotsData{}, err
+		return disallowAll, RobotsCooldown
 	}
 
-	req.Header.Set("User-Agent", rt.userAgent)
+	req.Header.Set("User-Agent", c.userAgent)
+
+	client := *c.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > MaxRedirects {
+			return ErrTooManyRedirects
+		}
+
+		return nil
+	}
 
 	resp, err := client.Do(req)
+
+	switch {
+	case errors.Is(err, ErrTooManyRedirects):
+		return allowAll, RobotsTTL
+	case err != nil:
+		return disallowAll, RobotsCooldown
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return disallowAll, RobotsCooldown
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxSize))
 	if err != nil {
-		return &robotstxt.RobotsData{}, err
+		return disallowAll, RobotsCooldown
 	}
 
-	defer resp.Body.Close()
+	// 4xx is handled as allow-all by parser
+	robots, err := robotstxt.FromStatusAndBytes(resp.StatusCode, body)
+	if err != nil {
+		return allowAll, RobotsTTL
+	}
+
+	return &Rules{RobotsData: robots, extensions: parseExtensions(body)}, RobotsTTL
+}
+
+// Get - rules for URL origin, fetched on first use and after expiry.
+func (c *Cache) Get(u *url.URL) *Rules {
+	origin := Origin(u)
+
+	c.lock.Lock()
+
+	if e, ok := c.entries[origin]; ok {
+		select {
+		case <-e.ready:
+			if time.Now().Before(e.expires) {
+				c.lock.Unlock()
+
+				return e.rules
+			}
+		default:
+			// fetch in progress
+			c.lock.Unlock()
+			<-e.ready
+
+			return e.rules
+		}
+	}
+
+	e := &entry{ready: make(chan struct{})}
+	c.entries[origin] = e
+	c.lock.Unlock()
+
+	rules, ttl := c.fetch(origin)
+	e.rules = rules
+	e.expires = time.Now().Add(ttl)
+	close(e.ready)
+
+	return rules
+}
+
+func NewCache(client *http.Client, userAgent string) *Cache {
+	return &Cache{entries: make(map[string]*entry), client: client, userAgent: userAgent}
+}
+
+type RoboTester struct {
+	cache    *Cache
+	seed     *url.URL
+	fullURL  string
+	products []string
+}
+
+// resolve - URL relative to seed.
+func (rt *RoboTester) resolve(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.seed != nil {
+		parsed = rt.seed.ResolveReference(parsed)
+	}
+
+	if !parsed.IsAbs() || parsed.Host == "" {
+		return nil, fmt.Errorf("not an absolute URL: %s", rawURL)
+	}
+
+	return parsed, nil
+}
+
+// rules - robots.txt rules that apply to URL.
+func (rt *RoboTester) rules(rawURL string) (*Rules, error) {
+	parsed, err := rt.resolve(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return rt.cache.Get(parsed), nil
+}
 
-	robots, err = robotstxt.FromResponse(resp)
-	resp.Body.Close()
+// GetRobots - robots.txt rules that apply to URL.
+func (rt *RoboTester) GetRobots(rawURL string) (robots *robotstxt.RobotsData, err error) {
+	rules, err := rt.rules(rawURL)
+	if err != nil {
+		return &robotstxt.RobotsData{}, err
+	}
 
-	return robots, err
+	return rules.RobotsData, nil
 }
 
-func (rt *RoboTester) Test(path string) bool {
-	if rt.gotRobots {
-		return !(!rt.robots.TestAgent(path, "domainsproject.org") || !rt.robots.TestAgent(path, "Domains Project"))
+// Test - whether URL may be fetched now according to robots.txt of its own origin,
+// Visit-time included. Relative URLs are resolved against seed.
+func (rt *RoboTester) Test(rawURL string) bool {
+	parsed, err := rt.resolve(rawURL)
+	if err != nil {
+		return false
+	}
+
+	path := parsed.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// robots.txt itself is always allowed
+	if path == "/robots.txt" {
+		return true
+	}
+
+	if parsed.RawQuery != "" {
+		path += "?" + parsed.RawQuery
+	}
+
+	rules := rt.cache.Get(parsed)
+	now := time.Now()
+
+	for _, product := range rt.agents() {
+		if !rules.TestAgent(path, product) || !rules.VisitAllowed(product, now) {
+			return false
+		}
 	}
 
 	return true
 }
 
-// GetDelay - be as careful as possible, if there are two definitions - sum them up and use both
+// GetDelay - delay between requests to seed host.
 func (rt *RoboTester) GetDelay() time.Duration {
-	if rt.gotRobots {
-		group1 := rt.robots.FindGroup("domainsproject.org")
-		group2 := rt.robots.FindGroup("Domains Project")
-		return group1.CrawlDelay + group2.CrawlDelay
+	return rt.Delay(rt.fullURL)
+}
+
+// Delay - delay between requests to URL host. Be as careful as possible, if products match
+// different groups - sum them up and use all. Group delay is the longest of Crawl-delay and Request-rate,
+// `*` group applies when product has none.
+func (rt *RoboTester) Delay(rawURL string) time.Duration {
+	rules, err := rt.rules(rawURL)
+	if err != nil {
+		// have at least one-second delay
+		return 1 * time.Second
 	}
-	// have at least one-second delay
-	return 1 * time.Second
+
+	var delay time.Duration
+
+	now := time.Now()
+	seen := make(map[*robotstxt.Group]struct{})
+
+	for _, product := range rt.agents() {
+		group := rules.FindGroup(product)
+		if _, ok := seen[group]; ok {
+			continue
+		}
+
+		seen[group] = struct{}{}
+		delay += rules.Delay(product, now)
+	}
+
+	return delay
 }
 
-func (rt *RoboTester) InitWithUA(ua string) {
-	rt.userAgent = ua
+// GetSitemaps - sitemaps advertised by seed robots.txt.
+func (rt *RoboTester) GetSitemaps() []string {
 	robots, err := rt.GetRobots(rt.fullURL)
+	if err != nil {
+		return nil
+	}
+
+	return robots.Sitemaps
+}
+
+func (rt *RoboTester) SetClient(client *http.Client) {
+	rt.cache.client = client
+}
+
+// SetProducts - product tokens matched against robots.txt user-agent lines.
+func (rt *RoboTester) SetProducts(products []string) {
+	rt.products = products
+}
 
-	if err == nil {
-		rt.robots = robots
-		rt.gotRobots = true
+// agents - product tokens, `*` group when there are none.
+func (rt *RoboTester) agents() []string {
+	if len(rt.products) == 0 {
+		return []string{"*"}
 	}
+
+	return rt.products
+}
+
+// InitWithUA - set User-Agent for robots.txt requests and fetch seed robots.txt.
+// Product tokens are derived from User-Agent unless set with SetProducts.
+func (rt *RoboTester) InitWithUA(ua string) {
+	rt.cache.userAgent = ua
+
+	if len(rt.products) == 0 {
+		rt.products = Products(ua)
+	}
+
+	_, _ = rt.GetRobots(rt.fullURL)
 }
 
 func NewRoboTester(fullURL string) *RoboTester {
-	return &RoboTester{fullURL: fullURL}
+	seed, err := url.Parse(fullURL)
+	if err != nil {
+		seed = nil
+	}
+
+	return &RoboTester{
+		cache:   NewCache(&http.Client{}, ""),
+		seed:    seed,
+		fullURL: fullURL,
+	}
 }
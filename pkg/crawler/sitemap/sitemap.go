@@ -0,0 +1,257 @@
+package sitemap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const (
+	DefaultPath = "/sitemap.xml"
+	// Sitemap protocol limits a single file to 50MB uncompressed and 50000 entries.
+	MaxSitemapSize    = 50 * types.OneMeg
+	MaxEntriesPerFile = 50000
+	// Crawl wide limits.
+	MaxSitemaps  = 32
+	MaxDepth     = 3
+	FetchTimeout = 30 * time.Second
+)
+
+var ErrNotOK = errors.New("non-ok response") // nolint:gochecknoglobals
+
+type Limits struct {
+	MaxSitemaps int
+	MaxEntries  int
+	MaxSize     int64
+	MaxDepth    int
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxSitemaps: MaxSitemaps,
+		MaxEntries:  MaxEntriesPerFile,
+		MaxSize:     MaxSitemapSize,
+		MaxDepth:    MaxDepth,
+	}
+}
+
+// Walker - fetches sitemaps and sitemap indexes and reports every host found in them.
+type Walker struct {
+	client    *http.Client
+	userAgent string
+	limits    Limits
+	allowed   func(string) bool
+	seen      map[string]struct{}
+	entries   int
+}
+
+// isGzip - check magic bytes, servers often send gzip files as application/octet-stream.
+func isGzip(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(2)
+
+	return err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b})
+}
+
+func (w *Walker) fetch(ctx context.Context, sitemapURL string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sitemapURL, nil)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", w.userAgent)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+
+		return nil, fmt.Errorf("%w: %d for %s", ErrNotOK, resp.StatusCode, sitemapURL)
+	}
+
+	return &body{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+type body struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *body) Close() error {
+	defer b.cancel()
+
+	return b.ReadCloser.Close()
+}
+
+// parse - stream sitemap XML, returning nested sitemaps and page URLs.
+func (w *Walker) parse(reader io.Reader, onURL func(string)) (nested []string, err error) {
+	buffered := bufio.NewReader(io.LimitReader(reader, w.limits.MaxSize))
+
+	var source io.Reader = buffered
+
+	if isGzip(buffered) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		// limit decompressed size as well
+		source = io.LimitReader(gz, w.limits.MaxSize)
+	}
+
+	decoder := xml.NewDecoder(source)
+	decoder.Strict = false
+
+	var parent string
+
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nested, nil
+		}
+
+		if err != nil {
+			return nested, err
+		}
+
+		el, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if el.Name.Local == "url" || el.Name.Local == "sitemap" {
+			parent = el.Name.Local
+
+			continue
+		}
+
+		if el.Name.Local != "loc" {
+			continue
+		}
+
+		var loc string
+		if err = decoder.DecodeElement(&loc, &el); err != nil {
+			return nested, err
+		}
+
+		loc = strings.TrimSpace(loc)
+		if len(loc) == 0 {
+			continue
+		}
+
+		if parent == "sitemap" {
+			nested = append(nested, loc)
+
+			continue
+		}
+
+		w.entries++
+		if w.entries > w.limits.MaxEntries {
+			return nested, nil
+		}
+
+		onURL(loc)
+	}
+}
+
+func (w *Walker) walk(ctx context.Context, sitemapURL string, depth int, onHost func(string)) {
+	if depth > w.limits.MaxDepth || len(w.seen) >= w.limits.MaxSitemaps || w.entries >= w.limits.MaxEntries {
+		return
+	}
+
+	if _, ok := w.seen[sitemapURL]; ok {
+		return
+	}
+
+	w.seen[sitemapURL] = struct{}{}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if !w.allowed(sitemapURL) {
+		log.Debugf("Sitemap %s is disallowed", sitemapURL)
+
+		return
+	}
+
+	reader, err := w.fetch(ctx, sitemapURL)
+	if err != nil {
+		log.Debugf("Sitemap fetch failed: %+v", err)
+
+		return
+	}
+
+	nested, err := w.parse(reader, func(loc string) {
+		parsed, err := url.Parse(loc)
+		if err != nil || len(parsed.Host) == 0 {
+			return
+		}
+
+		onHost(strings.ToLower(parsed.Host))
+	})
+	_ = reader.Close()
+
+	if err != nil {
+		log.Debugf("Sitemap %s parse failed: %+v", sitemapURL, err)
+	}
+
+	for _, next := range nested {
+		w.walk(ctx, next, depth+1, onHost)
+	}
+}
+
+// Walk - process sitemaps (and their indexes) calling onHost for every host found.
+func (w *Walker) Walk(ctx context.Context, sitemapURLs []string, onHost func(string)) {
+	for _, sitemapURL := range sitemapURLs {
+		w.walk(ctx, sitemapURL, 0, onHost)
+	}
+
+	log.Printf("Sitemaps processed: %d, entries: %d", len(w.seen), w.entries)
+}
+
+// Candidates - sitemaps advertised in robots.txt plus default location for target.
+func Candidates(targetURL string, fromRobots []string) []string {
+	candidates := make([]string, 0, len(fromRobots)+1)
+	candidates = append(candidates, fromRobots...)
+
+	parsed, err := url.Parse(targetURL)
+	if err == nil && len(parsed.Host) > 0 {
+		candidates = append(candidates, fmt.Sprintf("%s://%s%s", parsed.Scheme, parsed.Host, DefaultPath))
+	}
+
+	return candidates
+}
+
+// NewWalker - allowed is asked before every sitemap fetch, i.e. robots.txt check.
+func NewWalker(client *http.Client, userAgent string, limits Limits, allowed func(string) bool) *Walker {
+	return &Walker{
+		client:    client,
+		userAgent: userAgent,
+		limits:    limits,
+		allowed:   allowed,
+		seen:      make(map[string]struct{}),
+	}
+}
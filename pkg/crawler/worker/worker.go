@@ -2,87 +2,210 @@ package worker
 
 import (
 	"context"
-	"net/url"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/tb0hdan/idun/pkg/breaker"
+	"github.com/tb0hdan/idun/pkg/clients/apiclient"
+	"github.com/tb0hdan/idun/pkg/config"
+	"github.com/tb0hdan/idun/pkg/control"
 	"github.com/tb0hdan/idun/pkg/crawler/connection"
 	"github.com/tb0hdan/idun/pkg/crawler/crawlertools"
+	"github.com/tb0hdan/idun/pkg/crawler/progress"
+	"github.com/tb0hdan/idun/pkg/domain"
+	"github.com/tb0hdan/idun/pkg/metrics"
 	"github.com/tb0hdan/idun/pkg/types"
 	"github.com/tb0hdan/idun/pkg/utils"
 )
 
 type WorkerNode struct {
-	ApiBase     string
+	Config      *config.Live
 	Srvr        types.APIServerInterface
 	ServerAddr  string
-	DebugMode   bool
-	C           types.APIClientInterface
-	jobItems    []string
-	ConnTracker *connection.Tracker
+	WorkerCount int64
+	// MemoryBudget - memory shared by crawlers (container limit), 0 - unknown
+	MemoryBudget uint64
+	C            types.APIClientInterface
+	Queue        types.QueueInterface
+	Registry     types.RegistryInterface
+	Retry        *breaker.Backoff
+	Limiter      types.LimiterInterface
+	jobItems     []string
 }
 
 func (w WorkerNode) Process(ctx context.Context, item interface{}) (interface{}, error) {
 	domain := item.(string)
-	/*
-		if !w.ConnTracker.Check(domain) {
-			w.C.Debugf("Connection check for %s exceeds limit, skipping further processing...")
-			return domain, nil
-		} */
-	crawlertools.RunCrawl(w.ApiBase, domain, w.ServerAddr, w.DebugMode)
-	return domain, nil
+
+	crawl, err := control.Default.Begin(domain)
+	if err != nil {
+		// drain started after item was taken, keep it for next run
+		if err := w.Queue.Push(domain, 0); err != nil {
+			w.C.Debugf("Could not requeue %s: %+v", domain, err)
+		}
+
+		return nil, err
+	}
+
+	defer control.Default.End(crawl)
+	// config may change between crawls
+	cfg := w.Config.Get().Clone()
+	cfg.MemoryLimit = utils.MemoryPerWorker(cfg.MemoryLimit, w.MemoryBudget, w.WorkerCount)
+
+	if cfg.InProcess {
+		crawl.SetPID(os.Getpid())
+
+		return crawlertools.RunCrawlInProcess(ctx, cfg, w.C, domain, w.ServerAddr), nil
+	}
+
+	return crawlertools.RunCrawl(cfg, domain, w.ServerAddr, crawl), nil
+}
+
+// accept - whether this worker should crawl domain now. Rate limited domains are requeued
+// for when their network has capacity again, registry errors don't stop crawling.
+// Limit is only checked, tokens are taken by crawl requests, and claim comes after it
+// so that requeued domain isn't left claimed.
+func (w WorkerNode) accept(domain string) bool {
+	wait, allowed, err := connection.CheckHost(w.Limiter, domain)
+	if err != nil {
+		w.C.Debugf("Rate limit check of %s failed: %+v", domain, err)
+	} else if !allowed {
+		w.C.Debugf("%s is rate limited, requeueing in %s", domain, wait)
+
+		if err := w.Queue.PushAfter(domain, 0, wait); err != nil {
+			w.C.Debugf("Could not requeue %s: %+v", domain, err)
+		}
+
+		return false
+	}
+
+	return w.claim(domain)
+}
+
+func (w WorkerNode) claim(domain string) bool {
+	ok, err := w.Registry.Claim(domain, w.Config.Get().RegistryWindow)
+	if err != nil {
+		w.C.Debugf("Registry claim of %s failed: %+v", domain, err)
+
+		return true
+	}
+
+	if !ok {
+		w.C.Debugf("%s was recently crawled by another worker, skipping", domain)
+	}
+
+	return ok
 }
 
 func (w WorkerNode) GetItem(ctx context.Context) (interface{}, error) {
+	// blocks while paused or draining
+	if err := control.Default.Wait(ctx); err != nil {
+		return nil, err
+	}
 	// try popping first
-	domain := w.Srvr.Pop()
-	if len(domain) > 0 {
-		return domain, nil
+	for {
+		domain, err := w.Queue.Pop()
+		if err != nil {
+			w.C.Debugf("Queue pop failed: %+v", err)
+		}
+
+		if len(domain) == 0 {
+			break
+		}
+
+		if w.accept(domain) {
+			return domain, nil
+		}
 	}
 
 	// that didn't go well, try one of the job items
-	if len(w.jobItems) > 0 {
+	for len(w.jobItems) > 0 {
+		var domain string
+
 		domain, w.jobItems = w.jobItems[0], w.jobItems[1:]
 
-		return domain, nil
+		if w.accept(domain) {
+			return domain, nil
+		}
 	}
 	//
 	domains, err := w.C.GetDomains()
 	if err != nil {
-		time.Sleep(types.GetDomainsRetry)
+		// jittered and growing, so workers don't hit recovering API at once
+		timer := time.NewTimer(w.Retry.Next())
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
 
 		return nil, err
 	}
+
+	w.Retry.Reset()
 	// Starting crawlers is expensive, do HEAD check first
-	checkedMap := utils.HeadCheckDomains(domains, w.Srvr.GetUA())
+	checkedMap := utils.HeadCheckDomains(domains, w.Srvr.GetUA(), w.Config.Get().HeadCheckTimeout)
 
 	// only add checked domains
 	for d := range checkedMap {
 		w.jobItems = append(w.jobItems, d)
 	}
 
-	if len(w.jobItems) > 0 {
+	for len(w.jobItems) > 0 {
+		var domain string
+
 		domain, w.jobItems = w.jobItems[0], w.jobItems[1:]
 
-		return domain, nil
+		if w.accept(domain) {
+			return domain, nil
+		}
 	}
 
 	return nil, errors.New("could not get domain")
 }
 
 func (w WorkerNode) SubmitResult(ctx context.Context, result interface{}) error {
+	res := result.(*progress.Result)
+
+	for status, count := range res.Statuses {
+		metrics.CrawlPages.WithLabelValues(fmt.Sprintf("%dxx", status/100)).Add(float64(count))
+	}
+
+	metrics.CrawlPages.WithLabelValues("0xx").Add(float64(res.Failed))
+	metrics.CrawlDiscovered.Add(float64(res.Discovered))
+	metrics.CrawlRobotsDenied.Add(float64(res.RobotsDenied))
+
+	w.C.Debugf("Crawl of %s finished (%s) in %s: %d pages, %d bytes, %d failed, %d hosts discovered, %d denied by robots.txt",
+		res.Domain, res.Reason, res.Duration.Round(time.Second), res.Pages, res.Bytes, res.Failed, res.Discovered, res.RobotsDenied)
 	// convert possible url to domain
-	parsed, err := url.Parse(result.(string))
+	host, err := domain.Normalize(res.Domain)
 	if err != nil {
-		w.C.Debugf("Could not parse: %s with err: %s", result, err)
+		w.C.Debugf("Could not parse: %s with err: %s", res.Domain, err)
 
 		return nil
 	}
-	// might be empty
-	if len(parsed.Host) == 0 {
-		return nil
+
+	err = w.C.ReportResult(&types.CrawlResult{
+		Domain:     host,
+		FinalURL:   res.FinalURL,
+		Status:     res.Status,
+		Server:     res.Server,
+		Pages:      res.Pages,
+		Discovered: res.Discovered,
+		TLSVersion: res.TLSVersion,
+		TLSIssuer:  res.TLSIssuer,
+		Reason:     res.Reason,
+		Duration:   res.Duration.Seconds(),
+	})
+	// servers without /result are told about completion through filter
+	if errors.Is(err, apiclient.ErrNotSupported) {
+		_, err = w.C.FilterDomains([]string{host})
 	}
-	_, err = w.C.FilterDomains([]string{parsed.Host})
-	w.C.Debugf("Crawling of %s completed with status: %+v", result, err)
+
+	w.C.Debugf("Crawling of %s completed with status: %+v", res.Domain, err)
+
 	return nil
 }
@@ -0,0 +1,277 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	MaxDomainLength = 253
+	MaxLabelLength  = 63
+)
+
+var (
+	ErrEmpty         = errors.New("empty domain")   // nolint:gochecknoglobals
+	ErrInvalidDomain = errors.New("invalid domain") // nolint:gochecknoglobals
+	// defaultNormalizer - *Normalizer used by package level helpers.
+	defaultNormalizer atomic.Value // nolint:gochecknoglobals
+)
+
+// Default - normalizer used by package level helpers.
+func Default() *Normalizer {
+	if n, ok := defaultNormalizer.Load().(*Normalizer); ok {
+		return n
+	}
+
+	return &Normalizer{}
+}
+
+// SetDefault - replace normalizer used by package level helpers, safe while they are in use.
+func SetDefault(n *Normalizer) {
+	defaultNormalizer.Store(n)
+}
+
+type Normalizer struct {
+	// StripWWW - treat www.example.com and example.com as the same domain
+	StripWWW bool
+}
+
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > MaxLabelLength {
+		return false
+	}
+
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+
+	for _, r := range label {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hostPart - extract host from URL, host:port or bare host.
+func hostPart(raw string) string {
+	raw = strings.TrimSpace(raw)
+
+	if strings.Contains(raw, "://") {
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			return ""
+		}
+
+		raw = parsed.Host
+	}
+
+	if host, _, err := net.SplitHostPort(raw); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]")
+}
+
+// Normalize - convert URL or host to lowercase A-label (punycode) host without port and trailing dot.
+func (n *Normalizer) Normalize(raw string) (string, error) {
+	host := hostPart(raw)
+	if len(host) == 0 {
+		return "", ErrEmpty
+	}
+	// IP literals are kept as is
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	host = strings.TrimRight(host, ".")
+
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrInvalidDomain, host, err) // nolint:errorlint
+	}
+
+	ascii = strings.ToLower(ascii)
+
+	// www.com and www.co.uk are registrable domains themselves
+	if rest := strings.TrimPrefix(ascii, "www."); n.StripWWW && rest != ascii {
+		if _, err := publicsuffix.EffectiveTLDPlusOne(rest); err == nil {
+			ascii = rest
+		}
+	}
+
+	if len(ascii) > MaxDomainLength {
+		return "", fmt.Errorf("%w: %s is too long", ErrInvalidDomain, ascii)
+	}
+
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("%w: %s has no TLD", ErrInvalidDomain, ascii)
+	}
+
+	for _, label := range labels {
+		if !validLabel(label) {
+			return "", fmt.Errorf("%w: %s has invalid label %q", ErrInvalidDomain, ascii, label)
+		}
+	}
+
+	return ascii, nil
+}
+
+// RegistrableDomain - public suffix plus one label, i.e. example.co.uk for www.example.co.uk.
+func (n *Normalizer) RegistrableDomain(raw string) (string, error) {
+	host, err := n.Normalize(raw)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	return publicsuffix.EffectiveTLDPlusOne(host)
+}
+
+// Normalize - see Normalizer.Normalize.
+func Normalize(raw string) (string, error) {
+	return Default().Normalize(raw)
+}
+
+// RegistrableDomain - see Normalizer.RegistrableDomain.
+func RegistrableDomain(raw string) (string, error) {
+	return Default().RegistrableDomain(raw)
+}
+
+// NormalizeAll - normalize and deduplicate, invalid domains are dropped.
+func NormalizeAll(incoming []string) []string {
+	seen := make(map[string]struct{}, len(incoming))
+	outgoing := make([]string, 0, len(incoming))
+
+	for _, raw := range incoming {
+		host, err := Normalize(raw)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := seen[host]; ok {
+			continue
+		}
+
+		seen[host] = struct{}{}
+
+		outgoing = append(outgoing, host)
+	}
+
+	return outgoing
+}
+
+// Seed - crawl seed from input line. HTTP(S) URLs are kept with their path once their host is valid,
+// bare hosts (and hosts of other URLs) are normalized.
+func Seed(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+
+	host, err := Normalize(raw)
+	if err != nil {
+		return "", err
+	}
+
+	if ToURL(raw) == raw {
+		return raw, nil
+	}
+
+	return host, nil
+}
+
+// ToURL - add default scheme to bare domains.
+func ToURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if strings.HasPrefix(raw, "http://") || strings.HasPrefix(raw, "https://") {
+		return raw
+	}
+
+	return "http://" + raw
+}
+
+type ScopePolicy string
+
+const (
+	// ScopeHost - seed host only.
+	ScopeHost ScopePolicy = "host"
+	// ScopeSubdomains - seed host and its subdomains.
+	ScopeSubdomains ScopePolicy = "subdomains"
+	// ScopeRegistrable - everything under seed registrable domain, i.e. example.co.uk.
+	ScopeRegistrable ScopePolicy = "registrable"
+)
+
+var ErrUnknownScope = errors.New("unknown scope policy") // nolint:gochecknoglobals
+
+// IsSubdomain - host equals parent or is below it on a label boundary. notexample.com is not under example.com.
+func IsSubdomain(host, parent string) bool {
+	return host == parent || strings.HasSuffix(host, "."+parent)
+}
+
+// Scope - decides which hosts are internal to the crawl of a seed.
+type Scope struct {
+	policy      ScopePolicy
+	seed        string
+	registrable string
+}
+
+func (s *Scope) Seed() string {
+	return s.seed
+}
+
+// Contains - host is internal for this crawl and should be followed. Host must be normalized.
+func (s *Scope) Contains(host string) bool {
+	switch s.policy {
+	case ScopeHost:
+		return host == s.seed
+	case ScopeRegistrable:
+		registrable, err := publicsuffix.EffectiveTLDPlusOne(host)
+		if err != nil {
+			return host == s.seed
+		}
+
+		return registrable == s.registrable
+	case ScopeSubdomains:
+		return IsSubdomain(host, s.seed)
+	}
+
+	return false
+}
+
+func ParseScopePolicy(policy string) (ScopePolicy, error) {
+	switch ScopePolicy(policy) {
+	case ScopeHost, ScopeSubdomains, ScopeRegistrable:
+		return ScopePolicy(policy), nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownScope, policy)
+}
+
+func NewScope(seed string, policy ScopePolicy) (*Scope, error) {
+	host, err := Normalize(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = ParseScopePolicy(string(policy)); err != nil {
+		return nil, err
+	}
+
+	scope := &Scope{policy: policy, seed: host, registrable: host}
+
+	if registrable, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		scope.registrable = registrable
+	}
+
+	return scope, nil
+}
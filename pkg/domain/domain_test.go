@@ -0,0 +1,102 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		stripWWW bool
+		raw      string
+		want     string
+		err      error
+	}{
+		{name: "bare host", raw: "Example.COM", want: "example.com"},
+		{name: "url", raw: "https://example.com:8443/path?q=1", want: "example.com"},
+		{name: "host and port", raw: "example.com:80", want: "example.com"},
+		{name: "trailing dot", raw: "example.com.", want: "example.com"},
+		{name: "idn", raw: "пример.рф", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "ipv4", raw: "http://127.0.0.1/", want: "127.0.0.1"},
+		{name: "ipv6", raw: "[2001:DB8::1]:80", want: "2001:db8::1"},
+		{name: "www kept", raw: "www.example.com", want: "www.example.com"},
+		{name: "www stripped", stripWWW: true, raw: "www.example.com", want: "example.com"},
+		{name: "www registrable domain", stripWWW: true, raw: "www.com", want: "www.com"},
+		{name: "www under multi-label suffix", stripWWW: true, raw: "www.co.uk", want: "www.co.uk"},
+		{name: "www stripped under multi-label suffix", stripWWW: true, raw: "www.example.co.uk", want: "example.co.uk"},
+		{name: "empty", raw: "  ", err: ErrEmpty},
+		{name: "no tld", raw: "localhost", err: ErrInvalidDomain},
+		{name: "bad label", raw: "-example.com", err: ErrInvalidDomain},
+		{name: "underscore", raw: "ex_ample.com", err: ErrInvalidDomain},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			n := &Normalizer{StripWWW: tt.stripWWW}
+
+			got, err := n.Normalize(tt.raw)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Normalize(%q) error = %v, want %v", tt.raw, err, tt.err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeed(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		err  error
+	}{
+		{raw: " Example.com ", want: "example.com"},
+		{raw: "https://Example.com/start?page=2", want: "https://Example.com/start?page=2"},
+		{raw: "http://example.com", want: "http://example.com"},
+		{raw: "ftp://example.com/file", want: "example.com"},
+		{raw: "https://localhost/", err: ErrInvalidDomain},
+		{raw: "", err: ErrEmpty},
+	}
+
+	for _, tt := range tests {
+		got, err := Seed(tt.raw)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Seed(%q) error = %v, want %v", tt.raw, err, tt.err)
+		}
+
+		if got != tt.want {
+			t.Errorf("Seed(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	tests := []struct {
+		policy ScopePolicy
+		host   string
+		want   bool
+	}{
+		{ScopeHost, "www.example.co.uk", true},
+		{ScopeHost, "blog.www.example.co.uk", false},
+		{ScopeSubdomains, "blog.www.example.co.uk", true},
+		{ScopeSubdomains, "example.co.uk", false},
+		{ScopeSubdomains, "notwww.example.co.uk", false},
+		{ScopeRegistrable, "example.co.uk", true},
+		{ScopeRegistrable, "other.co.uk", false},
+	}
+
+	for _, tt := range tests {
+		scope, err := NewScope("https://www.example.co.uk/", tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := scope.Contains(tt.host); got != tt.want {
+			t.Errorf("%s scope Contains(%s) = %v, want %v", tt.policy, tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package ippolicy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	DialTimeout   = 30 * time.Second
+	DialKeepAlive = 30 * time.Second
+)
+
+var (
+	ErrBanned = errors.New("address is banned by IP policy") // nolint:gochecknoglobals
+
+	// nat64 - well-known NAT64 prefix, the last 32 bits are IPv4 address it translates to.
+	nat64 = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)} // nolint:gochecknoglobals
+
+	// DefaultCIDRs - IANA IPv4 and IPv6 special-purpose address registries plus multicast.
+	DefaultCIDRs = []string{ // nolint:gochecknoglobals
+		// IPv4
+		"0.0.0.0/8",          // "this" network
+		"10.0.0.0/8",         // private-use
+		"100.64.0.0/10",      // shared address space (CGNAT)
+		"127.0.0.0/8",        // loopback
+		"169.254.0.0/16",     // link-local, cloud metadata
+		"172.16.0.0/12",      // private-use
+		"192.0.0.0/24",       // IETF protocol assignments
+		"192.0.2.0/24",       // documentation (TEST-NET-1)
+		"192.31.196.0/24",    // AS112-v4
+		"192.52.193.0/24",    // AMT
+		"192.88.99.0/24",     // deprecated 6to4 relay anycast
+		"192.168.0.0/16",     // private-use
+		"192.175.48.0/24",    // direct delegation AS112 service
+		"198.18.0.0/15",      // benchmarking
+		"198.51.100.0/24",    // documentation (TEST-NET-2)
+		"203.0.113.0/24",     // documentation (TEST-NET-3)
+		"224.0.0.0/4",        // multicast
+		"240.0.0.0/4",        // reserved
+		"255.255.255.255/32", // limited broadcast
+		// IPv6
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"64:ff9b:1::/48", // IPv4-IPv6 translation, local-use
+		"100::/64",       // discard-only
+		"2001::/23",      // IETF protocol assignments, includes Teredo
+		"2001:db8::/32",  // documentation
+		"2002::/16",      // 6to4
+		"3fff::/20",      // documentation
+		"5f00::/16",      // segment routing SIDs
+		"fc00::/7",       // unique-local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	}
+
+	// Default - policy used by crawler and HEAD checks, replaced from config on start and on change.
+	Default = MustNew(DefaultCIDRs) // nolint:gochecknoglobals
+)
+
+// Policy - preparsed list of banned networks.
+type Policy struct {
+	lock sync.RWMutex
+	nets []*net.IPNet
+}
+
+// Replace - take networks of other policy. Transports created earlier see the change.
+func (p *Policy) Replace(other *Policy) {
+	other.lock.RLock()
+	nets := other.nets
+	other.lock.RUnlock()
+
+	p.lock.Lock()
+	p.nets = nets
+	p.lock.Unlock()
+}
+
+// Banned - IP belongs to one of banned networks. Unparseable addresses are banned too.
+func (p *Policy) Banned(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	// NAT64 addresses by both prefix and IPv4 address they embed
+	if len(ip) == net.IPv6len && nat64.Contains(ip) && p.Banned(ip[net.IPv6len-net.IPv4len:]) {
+		return true
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, ipNet := range p.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AnyBanned - at least one of resolved addresses is banned.
+func (p *Policy) AnyBanned(addrs []string) bool {
+	for _, addr := range addrs {
+		if p.Banned(net.ParseIP(addr)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Control - net.Dialer hook, runs after DNS resolution so redirects and rebinding can't reach banned networks.
+func (p *Policy) Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if p.Banned(net.ParseIP(host)) {
+		return fmt.Errorf("%w: %s", ErrBanned, host)
+	}
+
+	return nil
+}
+
+// DialContext - dialer that refuses connections to banned networks.
+func (p *Policy) DialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   DialTimeout,
+		KeepAlive: DialKeepAlive,
+		Control:   p.Control,
+	}
+
+	return dialer.DialContext
+}
+
+// Transport - cleanhttp transport with policy enforced at connect time. Proxy is not used,
+// policy would check its address instead of the one requested.
+func (p *Policy) Transport() *http.Transport {
+	transport := cleanhttp.DefaultPooledTransport()
+	transport.DialContext = p.DialContext()
+	transport.Proxy = nil
+
+	return transport
+}
+
+func readCIDRs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cidrs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.Index(line, "#"); pos >= 0 {
+			line = line[:pos]
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		cidrs = append(cidrs, line)
+	}
+
+	return cidrs, scanner.Err()
+}
+
+// New - parse CIDR list. Bare addresses are accepted as single host networks.
+func New(cidrs []string) (*Policy, error) {
+	policy := &Policy{nets: make([]*net.IPNet, 0, len(cidrs))}
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		policy.nets = append(policy.nets, ipNet)
+	}
+
+	return policy, nil
+}
+
+func MustNew(cidrs []string) *Policy {
+	policy, err := New(cidrs)
+	if err != nil {
+		panic(err)
+	}
+
+	return policy
+}
+
+// Load - DefaultCIDRs, or CIDR file contents when set, plus extra networks.
+func Load(file string, extra []string) (*Policy, error) {
+	cidrs := DefaultCIDRs
+
+	if len(file) > 0 {
+		fromFile, err := readCIDRs(file)
+		if err != nil {
+			return nil, err
+		}
+
+		cidrs = fromFile
+	}
+
+	return New(append(append([]string{}, cidrs...), extra...))
+}
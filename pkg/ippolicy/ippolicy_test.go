@@ -0,0 +1,102 @@
+package ippolicy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+		nets  int
+		fails bool
+	}{
+		{name: "defaults", cidrs: DefaultCIDRs, nets: len(DefaultCIDRs)},
+		{name: "bare addresses", cidrs: []string{"192.0.2.1", "2001:db8::1"}, nets: 2},
+		{name: "blank entries", cidrs: []string{"", " 10.0.0.0/8 "}, nets: 1},
+		{name: "garbage", cidrs: []string{"10.0.0.0/33"}, fails: true},
+	}
+
+	for _, tt := range tests {
+		policy, err := New(tt.cidrs)
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: New() error = %v", tt.name, err)
+
+			continue
+		}
+
+		if err == nil && len(policy.nets) != tt.nets {
+			t.Errorf("%s: %d networks, want %d", tt.name, len(policy.nets), tt.nets)
+		}
+	}
+
+	if policy := MustNew([]string{"192.0.2.1"}); !policy.Banned(net.ParseIP("192.0.2.1")) ||
+		policy.Banned(net.ParseIP("192.0.2.2")) {
+		t.Errorf("bare address is not a single host network")
+	}
+}
+
+func TestBanned(t *testing.T) {
+	policy := MustNew(DefaultCIDRs)
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		// IPv4-mapped
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:8.8.8.8", false},
+		// NAT64 well-known prefix, by embedded IPv4
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::808:808", false},
+		{"64:ff9b:1::808:808", true},
+		{"garbage", true},
+	}
+
+	for _, tt := range tests {
+		if got := policy.Banned(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Banned(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if !MustNew([]string{"64:ff9b::/96"}).Banned(net.ParseIP("64:ff9b::808:808")) {
+		t.Errorf("NAT64 prefix itself is not checked")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	transport := MustNew(DefaultCIDRs).Transport()
+	// dial hook would check proxy address instead of requested one
+	if transport.Proxy != nil {
+		t.Errorf("policy transport uses proxy")
+	}
+
+	_, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if !errors.Is(err, ErrBanned) {
+		t.Errorf("loopback request error = %v, want %v", err, ErrBanned)
+	}
+
+	resp, err := (&http.Client{Transport: MustNew(nil).Transport()}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request with empty policy failed: %v", err)
+	}
+
+	resp.Body.Close()
+}
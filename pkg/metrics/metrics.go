@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	Namespace = "idun"
+	// crawl exit reasons.
+	ExitNormal  = "normal"
+	ExitTimeout = "timeout"
+	// ExitOOMKill - killed by kernel OOM killer in crawler cgroup or out of address space.
+	ExitOOMKill = "oom_kill"
+	// ExitMemoryLimit - memory limit exceeded according to RSS polling.
+	ExitMemoryLimit = "memory_limit"
+	ExitCPULimit    = "cpu_limit"
+	ExitError       = "error"
+	// check results.
+	ResultPass = "pass"
+	ResultFail = "fail"
+)
+
+var (
+	DomainsPopped = promauto.NewCounter(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "domains_popped_total",
+		Help:      "Domains popped from the local queue",
+	})
+
+	DomainsUploaded = promauto.NewCounter(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "domains_uploaded_total",
+		Help:      "Valid unique domains uploaded by crawlers through /upload and queued",
+	})
+
+	FilterCalls = promauto.NewCounterVec(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "filter_calls_total",
+		Help:      "FilterDomains calls by result",
+	}, []string{"result"})
+
+	FilterDuration = promauto.NewHistogram(prometheus.HistogramOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "filter_duration_seconds",
+		Help:      "FilterDomains call latency",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	HeadChecks = promauto.NewCounterVec(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "head_checks_total",
+		Help:      "HEAD checks by result",
+	}, []string{"result"})
+
+	CrawlExits = promauto.NewCounterVec(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "crawl_exits_total",
+		Help:      "Crawl subprocess exits by reason",
+	}, []string{"reason"})
+
+	CrawlDuration = promauto.NewHistogram(prometheus.HistogramOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "crawl_duration_seconds",
+		Help:      "Crawl subprocess run time",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	})
+
+	CrawlPages = promauto.NewCounterVec(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "crawl_pages_total",
+		Help:      "Pages fetched by crawlers by status class, failed requests are class 0xx",
+	}, []string{"status"})
+
+	CrawlDiscovered = promauto.NewCounter(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "crawl_discovered_hosts_total",
+		Help:      "Hosts discovered by crawlers, before filtering",
+	})
+
+	CrawlRobotsDenied = promauto.NewCounter(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "crawl_robots_denied_total",
+		Help:      "Requests not sent because of robots.txt",
+	})
+
+	QueueSize = promauto.NewGauge(prometheus.GaugeOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "queue_size",
+		Help:      "Domains waiting in the local queue",
+	})
+
+	SpoolBatches = promauto.NewGauge(prometheus.GaugeOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "spool_batches",
+		Help:      "Filter batches waiting in the spool",
+	})
+
+	SpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "spool_bytes",
+		Help:      "Spool size on disk",
+	})
+
+	SpoolWritten = promauto.NewCounter(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "spool_written_domains_total",
+		Help:      "Domains written to the spool after failed filter requests",
+	})
+
+	SpoolReplayed = promauto.NewCounter(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "spool_replayed_domains_total",
+		Help:      "Spooled domains successfully sent to the API",
+	})
+
+	SpoolDropped = promauto.NewCounter(prometheus.CounterOpts{ // nolint:gochecknoglobals
+		Namespace: Namespace,
+		Name:      "spool_dropped_domains_total",
+		Help:      "Domains dropped because the spool was full",
+	})
+)
+
+// ObserveFilter - record FilterDomains outcome and latency.
+func ObserveFilter(started time.Time, err error) {
+	ObserveFilterDuration(time.Since(started), err != nil)
+}
+
+// ObserveFilterDuration - record outcome and latency of FilterDomains call timed elsewhere, i.e. in crawler subprocess.
+func ObserveFilterDuration(duration time.Duration, failed bool) {
+	FilterDuration.Observe(duration.Seconds())
+
+	if failed {
+		FilterCalls.WithLabelValues(ResultFail).Inc()
+
+		return
+	}
+
+	FilterCalls.WithLabelValues(ResultPass).Inc()
+}
+
+// ObserveCrawlExit - record crawl subprocess exit reason and run time.
+func ObserveCrawlExit(reason string, started time.Time) {
+	CrawlExits.WithLabelValues(reason).Inc()
+	CrawlDuration.Observe(time.Since(started).Seconds())
+}
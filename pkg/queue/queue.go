@@ -0,0 +1,438 @@
+package queue
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/metrics"
+)
+
+const (
+	JournalName = "queue.jsonl"
+	// compact journal when it holds this many stale records.
+	CompactThreshold = 4096
+	//
+	opPush = "push"
+	opPop  = "pop"
+)
+
+var ErrQueueFull = errors.New("queue is full") // nolint:gochecknoglobals
+
+type record struct {
+	Op       string `json:"op"`
+	Domain   string `json:"domain"`
+	Priority int    `json:"priority,omitempty"`
+	Added    int64  `json:"added,omitempty"`
+	// NotBefore - unix time before which domain isn't popped.
+	NotBefore int64 `json:"not_before,omitempty"`
+}
+
+type entry struct {
+	domain    string
+	priority  int
+	added     int64
+	notBefore int64
+	seq       uint64
+	index     int
+	delayed   bool
+}
+
+// entries - higher priority first, FIFO within the same priority.
+type entries []*entry
+
+func (e entries) Len() int { return len(e) }
+
+func (e entries) Less(i, j int) bool {
+	if e[i].priority != e[j].priority {
+		return e[i].priority > e[j].priority
+	}
+
+	return e[i].seq < e[j].seq
+}
+
+func (e entries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].index = i
+	e[j].index = j
+}
+
+func (e *entries) Push(x interface{}) {
+	item := x.(*entry)
+	item.index = len(*e)
+	*e = append(*e, item)
+}
+
+func (e *entries) Pop() interface{} {
+	old := *e
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*e = old[:n-1]
+
+	return item
+}
+
+// delayedEntries - soonest due first.
+type delayedEntries struct {
+	entries
+}
+
+func (d delayedEntries) Less(i, j int) bool {
+	return d.entries[i].notBefore < d.entries[j].notBefore
+}
+
+// FileQueue - durable priority queue backed by append-only journal file.
+type FileQueue struct {
+	path    string
+	expires int64
+	maxSize int
+	//
+	lock    sync.Mutex
+	journal *os.File
+	writer  *bufio.Writer
+	items   entries
+	delayed delayedEntries
+	byName  map[string]*entry
+	seq     uint64
+	stale   int
+	logger  *log.Logger
+}
+
+func (q *FileQueue) expired(e *entry, now int64) bool {
+	return q.expires > 0 && now-e.added > q.expires
+}
+
+func (q *FileQueue) write(rec *record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err = q.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return q.writer.Flush()
+}
+
+func (q *FileQueue) push(domain string, priority int, added, notBefore int64) {
+	if existing, ok := q.byName[domain]; ok {
+		// re-push refreshes expiry, like memcache SetEx did
+		if added > existing.added {
+			existing.added = added
+		}
+		// keep original position unless priority was raised
+		if priority > existing.priority {
+			existing.priority = priority
+			// delayed entries are ordered by time only
+			if !existing.delayed {
+				heap.Fix(&q.items, existing.index)
+			}
+		}
+
+		q.stale++
+
+		return
+	}
+
+	q.seq++
+	item := &entry{domain: domain, priority: priority, added: added, notBefore: notBefore, seq: q.seq}
+	q.byName[domain] = item
+
+	if notBefore > time.Now().Unix() {
+		item.delayed = true
+		heap.Push(&q.delayed, item)
+
+		return
+	}
+
+	heap.Push(&q.items, item)
+}
+
+func (q *FileQueue) remove(domain string) {
+	item, ok := q.byName[domain]
+	if !ok {
+		return
+	}
+
+	if item.delayed {
+		heap.Remove(&q.delayed, item.index)
+	} else {
+		heap.Remove(&q.items, item.index)
+	}
+
+	delete(q.byName, domain)
+	q.stale += 2
+}
+
+// promote - move delayed entries that are due to main queue.
+func (q *FileQueue) promote(now int64) {
+	for q.delayed.Len() > 0 && q.delayed.entries[0].notBefore <= now {
+		item := heap.Pop(&q.delayed).(*entry)
+		item.delayed = false
+		heap.Push(&q.items, item)
+	}
+}
+
+func (q *FileQueue) size() int {
+	return len(q.items) + len(q.delayed.entries)
+}
+
+func (q *FileQueue) replay() error {
+	f, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rec := &record{}
+		// partially written tail line after crash
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			continue
+		}
+
+		switch rec.Op {
+		case opPush:
+			q.push(rec.Domain, rec.Priority, rec.Added, rec.NotBefore)
+		case opPop:
+			q.remove(rec.Domain)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// compact - rewrite journal with live entries only.
+func (q *FileQueue) compact() error {
+	now := time.Now().Unix()
+	tmpPath := q.path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(f)
+	live := make(entries, 0, len(q.items))
+	liveDelayed := make(entries, 0, len(q.delayed.entries))
+
+	for _, item := range append(append(entries{}, q.items...), q.delayed.entries...) {
+		if q.expired(item, now) {
+			delete(q.byName, item.domain)
+
+			continue
+		}
+
+		data, err := json.Marshal(&record{
+			Op: opPush, Domain: item.domain, Priority: item.priority, Added: item.added, NotBefore: item.notBefore,
+		})
+		if err != nil {
+			_ = f.Close()
+
+			return err
+		}
+
+		_, _ = writer.Write(append(data, '\n'))
+
+		if item.delayed {
+			liveDelayed = append(liveDelayed, item)
+		} else {
+			live = append(live, item)
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, q.path); err != nil {
+		return err
+	}
+
+	for idx, item := range live {
+		item.index = idx
+	}
+
+	for idx, item := range liveDelayed {
+		item.index = idx
+	}
+
+	q.items = live
+	heap.Init(&q.items)
+	q.delayed = delayedEntries{liveDelayed}
+	heap.Init(&q.delayed)
+	q.stale = 0
+
+	if q.journal != nil {
+		_ = q.journal.Close()
+	}
+
+	return q.open()
+}
+
+func (q *FileQueue) open() error {
+	journal, err := os.OpenFile(q.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	q.journal = journal
+	q.writer = bufio.NewWriter(journal)
+
+	return nil
+}
+
+func (q *FileQueue) maybeCompact() {
+	if q.stale < CompactThreshold || q.stale < q.size() {
+		return
+	}
+
+	if err := q.compact(); err != nil {
+		q.logger.Errorf("Queue compaction failed: %+v", err)
+	}
+}
+
+// Push - add domain to queue. Domains already queued are not duplicated, their expiry is refreshed.
+func (q *FileQueue) Push(domain string, priority int) error {
+	return q.PushAfter(domain, priority, 0)
+}
+
+// PushAfter - add domain that isn't popped until delay passes.
+func (q *FileQueue) PushAfter(domain string, priority int, delay time.Duration) error {
+	if len(domain) == 0 {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, ok := q.byName[domain]; !ok && q.maxSize > 0 && q.size() >= q.maxSize {
+		return ErrQueueFull
+	}
+
+	now := time.Now()
+	added := now.Unix()
+
+	var notBefore int64
+	if delay > 0 {
+		// round up, so delay is never shorter than requested
+		notBefore = now.Add(delay + time.Second - 1).Unix()
+	}
+
+	if err := q.write(&record{Op: opPush, Domain: domain, Priority: priority, Added: added, NotBefore: notBefore}); err != nil {
+		return err
+	}
+
+	q.push(domain, priority, added, notBefore)
+	q.maybeCompact()
+	metrics.QueueSize.Set(float64(q.size()))
+
+	return nil
+}
+
+// Pop - get next domain, returns empty string when queue is empty.
+func (q *FileQueue) Pop() (string, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now().Unix()
+	q.promote(now)
+
+	for len(q.items) > 0 {
+		item := heap.Pop(&q.items).(*entry)
+		delete(q.byName, item.domain)
+		q.stale += 2
+
+		if err := q.write(&record{Op: opPop, Domain: item.domain}); err != nil {
+			return "", err
+		}
+
+		if q.expired(item, now) {
+			continue
+		}
+
+		q.maybeCompact()
+		metrics.DomainsPopped.Inc()
+		metrics.QueueSize.Set(float64(q.size()))
+
+		return item.domain, nil
+	}
+
+	q.maybeCompact()
+
+	return "", nil
+}
+
+// Len - queued domains, delayed ones included.
+func (q *FileQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.size()
+}
+
+func (q *FileQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.writer.Flush(); err != nil {
+		return err
+	}
+
+	return q.journal.Close()
+}
+
+// New - open (or create) queue journal in dataDir. Expires is in seconds, 0 disables expiration.
+// MaxSize of 0 means unlimited.
+func New(dataDir string, expires int64, maxSize int, logger *log.Logger) (*FileQueue, error) {
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	q := &FileQueue{
+		path:    filepath.Join(dataDir, JournalName),
+		expires: expires,
+		maxSize: maxSize,
+		byName:  make(map[string]*entry),
+		logger:  logger,
+	}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	// start with clean journal
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	metrics.QueueSize.Set(float64(q.size()))
+	logger.Printf("Queue loaded from %s with %d domains", q.path, q.size())
+
+	return q, nil
+}
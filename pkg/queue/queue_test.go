@@ -0,0 +1,210 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func journal(t *testing.T, dir string, records ...record) {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(dir, JournalName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, rec := range records {
+		data, err := json.Marshal(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write(append(data, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// partially written tail line after crash
+	if _, err = f.WriteString(`{"op":"pu`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func drain(t *testing.T, q *FileQueue) []string {
+	t.Helper()
+
+	popped := make([]string, 0)
+
+	for {
+		domain, err := q.Pop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if domain == "" {
+			return popped
+		}
+
+		popped = append(popped, domain)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name    string
+		expires int64
+		records []record
+		want    []string
+	}{
+		{
+			name: "fifo within priority",
+			records: []record{
+				{Op: opPush, Domain: "a.com", Added: now},
+				{Op: opPush, Domain: "b.com", Added: now},
+				{Op: opPush, Domain: "c.com", Priority: 1, Added: now},
+			},
+			want: []string{"c.com", "a.com", "b.com"},
+		},
+		{
+			name: "popped and duplicates",
+			records: []record{
+				{Op: opPush, Domain: "a.com", Added: now},
+				{Op: opPush, Domain: "b.com", Added: now},
+				{Op: opPop, Domain: "a.com"},
+				{Op: opPush, Domain: "b.com", Added: now},
+				{Op: opPush, Domain: "c.com", Added: now},
+			},
+			want: []string{"b.com", "c.com"},
+		},
+		{
+			name: "raised priority",
+			records: []record{
+				{Op: opPush, Domain: "a.com", Added: now},
+				{Op: opPush, Domain: "b.com", Added: now},
+				{Op: opPush, Domain: "b.com", Priority: 2, Added: now},
+			},
+			want: []string{"b.com", "a.com"},
+		},
+		{
+			name:    "expired",
+			expires: 60,
+			records: []record{
+				{Op: opPush, Domain: "a.com", Added: now - 120},
+				{Op: opPush, Domain: "b.com", Added: now},
+			},
+			want: []string{"b.com"},
+		},
+		{
+			name:    "re-push refreshes expiry",
+			expires: 60,
+			records: []record{
+				{Op: opPush, Domain: "a.com", Added: now - 120},
+				{Op: opPush, Domain: "a.com", Added: now},
+			},
+			want: []string{"a.com"},
+		},
+		{
+			name: "delayed",
+			records: []record{
+				{Op: opPush, Domain: "a.com", Added: now, NotBefore: now + 3600},
+				{Op: opPush, Domain: "b.com", Added: now, NotBefore: now - 1},
+			},
+			want: []string{"b.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			journal(t, dir, tt.records...)
+
+			q, err := New(dir, tt.expires, 0, log.New())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer q.Close()
+
+			got := drain(t, q)
+			if len(got) != len(tt.want) {
+				t.Fatalf("popped %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("popped %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := New(dir, 0, 0, log.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"a.com", "b.com", "c.com"} {
+		if err = q.Push(domain, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = q.PushAfter("d.com", 0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if domain, _ := q.Pop(); domain != "a.com" {
+		t.Fatalf("Pop() = %s, want a.com", domain)
+	}
+	// stale records push it over the threshold
+	for i := 0; i < CompactThreshold; i++ {
+		if err = q.Push("b.com", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, JournalName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+
+	if lines > CompactThreshold/2 {
+		t.Errorf("journal has %d lines after compaction", lines)
+	}
+
+	q, err = New(dir, 0, 0, log.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if q.Len() != 3 {
+		t.Errorf("Len() after reopen = %d, want 3", q.Len())
+	}
+
+	if got := drain(t, q); len(got) != 2 || got[0] != "b.com" || got[1] != "c.com" {
+		t.Errorf("popped %v after reopen, want [b.com c.com]", got)
+	}
+}
@@ -0,0 +1,277 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const (
+	FileName = "registry.jsonl"
+	LockName = "registry.lock"
+	// CompactThreshold - claims log isn't compacted while shorter than this.
+	CompactThreshold = 4096
+	// registry kinds.
+	KindNone   = "none"
+	KindFile   = "file"
+	KindConsul = "consul"
+)
+
+var (
+	ErrUnknownKind = errors.New("unknown registry")                // nolint:gochecknoglobals
+	ErrNoConsul    = errors.New("consul registry requires CONSUL") // nolint:gochecknoglobals
+)
+
+// claim - claims log record.
+type claim struct {
+	Domain string `json:"domain"`
+	// Claimed - unix time of claim.
+	Claimed int64 `json:"claimed"`
+}
+
+// Nop - registry that grants every claim, used when sharing is disabled.
+type Nop struct{}
+
+func (Nop) Claim(domain string, window time.Duration) (bool, error) {
+	return true, nil
+}
+
+// File - registry shared by workers on one host through append-only claims log in common data directory.
+// Claims are serialized with flock, so it works across processes and containers sharing the volume.
+// Every process keeps claims in memory and reads only records appended since its last claim.
+type File struct {
+	path     string
+	lockPath string
+	//
+	lock    sync.Mutex
+	claims  map[string]int64
+	info    os.FileInfo
+	offset  int64
+	torn    bool
+	records int
+	base    int
+}
+
+// load - apply records appended since last call, whole log when it was replaced by compaction.
+func (f *File) load() error {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.claims, f.info, f.offset, f.torn, f.records, f.base = make(map[string]int64), nil, 0, false, 0, 0
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	full := f.info == nil || !os.SameFile(f.info, info) || info.Size() < f.offset
+	if full {
+		f.claims, f.offset, f.torn, f.records = make(map[string]int64), 0, false, 0
+	}
+
+	f.info = info
+
+	if _, err = file.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// partially written tail line after crash, read again once terminated
+			f.torn = len(line) > 0
+
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		f.offset += int64(len(line))
+		f.records++
+
+		rec := &claim{}
+		if err = json.Unmarshal(line, rec); err != nil {
+			continue
+		}
+
+		if rec.Claimed > f.claims[rec.Domain] {
+			f.claims[rec.Domain] = rec.Claimed
+		}
+	}
+
+	if full {
+		f.base = f.records
+	}
+
+	return nil
+}
+
+func (f *File) append(rec *claim) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if f.torn {
+		data = append([]byte{'\n'}, data...)
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+// compact - replace log with claims still within window.
+func (f *File) compact(window time.Duration) error {
+	cutoff := time.Now().Add(-window).Unix()
+	tmpPath := f.path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+
+	for name, claimed := range f.claims {
+		if claimed <= cutoff {
+			continue
+		}
+
+		data, err := json.Marshal(&claim{Domain: name, Claimed: claimed})
+		if err != nil {
+			_ = file.Close()
+
+			return err
+		}
+
+		_, _ = writer.Write(append(data, '\n'))
+	}
+
+	if err = writer.Flush(); err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, f.path); err != nil {
+		return err
+	}
+	// read compacted log on next claim
+	f.info = nil
+
+	return nil
+}
+
+// Claim - claim is in the log before true is returned. Log is compacted once it doubles since last compaction.
+func (f *File) Claim(domain string, window time.Duration) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	lockFile, err := os.OpenFile(f.lockPath, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return false, err
+	}
+	defer lockFile.Close()
+
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return false, err
+	}
+	// lock is released on close
+	if err = f.load(); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if claimed, ok := f.claims[domain]; ok && claimed > now.Add(-window).Unix() {
+		return false, nil
+	}
+
+	if err = f.append(&claim{Domain: domain, Claimed: now.Unix()}); err != nil {
+		return false, err
+	}
+
+	f.claims[domain] = now.Unix()
+
+	if f.records < CompactThreshold || f.records < 2*f.base {
+		return true, nil
+	}
+	// claim is recorded, compaction errors are only reported
+	return true, f.compact(window)
+}
+
+// NewFile - registry stored in dataDir/registry.jsonl.
+func NewFile(dataDir string) (*File, error) {
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &File{
+		path:     filepath.Join(dataDir, FileName),
+		lockPath: filepath.Join(dataDir, LockName),
+		claims:   make(map[string]int64),
+	}, nil
+}
+
+// New - registry of given kind. Consul is nil when Consul isn't configured.
+func New(kind, dir string, consul types.RegistryInterface) (types.RegistryInterface, error) {
+	switch kind {
+	case "", KindNone:
+		return Nop{}, nil
+	case KindFile:
+		return NewFile(dir)
+	case KindConsul:
+		if consul == nil {
+			return nil, ErrNoConsul
+		}
+
+		return consul, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+}
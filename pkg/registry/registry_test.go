@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileClaim(t *testing.T) {
+	dir := t.TempDir()
+	expired := time.Now().Add(-2 * time.Hour).Unix()
+	// expired claim and partially written tail line after crash
+	log := fmt.Sprintf(`{"domain":"old.com","claimed":%d}`+"\n"+`{"domain":"to`, expired)
+
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte(log), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another worker sharing the directory
+	second, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		registry *File
+		domain   string
+		want     bool
+	}{
+		{"new domain", first, "a.com", true},
+		{"claimed by the same worker", first, "a.com", false},
+		{"claimed by another worker", second, "a.com", false},
+		{"expired claim", second, "old.com", true},
+		{"expired claim taken by another worker", first, "old.com", false},
+		{"after torn line", first, "b.com", true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.registry.Claim(tt.domain, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: Claim() error = %v", tt.name, err)
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: Claim(%s) = %v, want %v", tt.name, tt.domain, got, tt.want)
+		}
+	}
+
+	reopened, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.com", "old.com", "b.com"} {
+		if ok, _ := reopened.Claim(name, time.Hour); ok {
+			t.Errorf("claim of %s lost", name)
+		}
+	}
+}
+
+func TestFileCompaction(t *testing.T) {
+	dir := t.TempDir()
+	expired := time.Now().Add(-2 * time.Hour).Unix()
+
+	var log []byte
+	for i := 0; i < CompactThreshold; i++ {
+		log = append(log, fmt.Sprintf(`{"domain":"%d.com","claimed":%d}`+"\n", i, expired)...)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, FileName), log, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = registry.load(); err != nil {
+		t.Fatal(err)
+	}
+	// as if log doubled since it was loaded
+	registry.base = CompactThreshold / 2
+
+	if ok, err := registry.Claim("live.com", time.Hour); !ok || err != nil {
+		t.Fatalf("Claim() = %v, %v", ok, err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+
+	if lines != 1 {
+		t.Errorf("claims log has %d lines after compaction, want 1", lines)
+	}
+
+	reopened, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := reopened.Claim("live.com", time.Hour); ok {
+		t.Errorf("live claim lost in compaction")
+	}
+
+	if ok, _ := reopened.Claim("0.com", time.Hour); !ok {
+		t.Errorf("expired claim kept in compaction")
+	}
+}
@@ -3,18 +3,17 @@ package apiserver
 import (
 	"encoding/json"
 	"net/http"
-	"strings"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/tb0hdan/idun/pkg/domain"
+	"github.com/tb0hdan/idun/pkg/metrics"
 	"github.com/tb0hdan/idun/pkg/types"
-	"github.com/tb0hdan/memcache"
 )
 
 type apiServer struct {
-	Cache     *memcache.CacheType
+	Queue     types.QueueInterface
 	UserAgent string
-	Expires   int64
 }
 
 func (s *apiServer) GetUA() string {
@@ -39,11 +38,20 @@ func (s *apiServer) UploadDomains(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, domain := range domainsResponse.Domains {
-		s.Cache.SetEx(domain, "1", s.Expires)
-	}
+	queued := 0
+
+	for _, host := range domain.NormalizeAll(domainsResponse.Domains) {
+		if err := s.Queue.Push(host, 0); err != nil {
+			log.Errorf("Could not queue %s: %+v", host, err)
 
-	log.Println("Domains in memcache: ", s.Cache.LenSafe())
+			continue
+		}
+
+		queued++
+	}
+	// invalid, duplicate and rejected domains aren't counted
+	metrics.DomainsUploaded.Add(float64(queued))
+	log.Println("Domains in queue: ", s.Queue.Len())
 }
 
 func (s *apiServer) UA(w http.ResponseWriter, r *http.Request) {
@@ -63,39 +71,26 @@ func (s *apiServer) UA(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *apiServer) Pop() string {
-	var item string
+	item, err := s.Queue.Pop()
+	if err != nil {
+		log.Error("Pop error: ", err.Error())
 
-	if s.Cache.LenSafe() == 0 {
 		return ""
 	}
 
-	for k := range s.Cache.Cache() {
-		if strings.HasPrefix(k, "conntrack_") {
-			continue
-		}
-		if len(k) == 0 {
-			continue
-		}
-
-		item = k
-		break
-	}
-
 	// no domains found yet
 	if len(item) == 0 {
 		return ""
 	}
 
-	s.Cache.Delete(item)
 	log.Println("Popped", item)
 
 	return item
 }
 
-func NewAPIServer(cache *memcache.CacheType, ua string, expires int64) *apiServer {
+func NewAPIServer(queue types.QueueInterface, ua string) *apiServer {
 	return &apiServer{
-		Cache:     cache,
+		Queue:     queue,
 		UserAgent: ua,
-		Expires:   expires,
 	}
 }
@@ -0,0 +1,331 @@
+package mockapi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/domain"
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const (
+	DefaultBatchSize = 100
+	// MaxBodySize - limit for (decompressed) request bodies.
+	MaxBodySize = 32 * types.OneMeg
+)
+
+// Store - seed domains in, discovered domains and crawl results out. Every domain is handed out at most once,
+// handed out domains are recorded so the rest is served again after restart.
+type Store struct {
+	lock    sync.Mutex
+	pending []string
+	seen    map[string]struct{}
+	out     *os.File
+	served  *os.File
+	results *os.File
+}
+
+func readDomains(path string, fn func(string)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		host, err := domain.Normalize(scanner.Text())
+		if err != nil {
+			continue
+		}
+
+		fn(host)
+	}
+
+	return scanner.Err()
+}
+
+// Next - up to count domains to crawl.
+func (s *Store) Next(count int) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if count > len(s.pending) {
+		count = len(s.pending)
+	}
+
+	batch := make([]string, count)
+	copy(batch, s.pending[:count])
+	s.pending = s.pending[count:]
+
+	if count > 0 {
+		if _, err := s.served.WriteString(strings.Join(batch, "\n") + "\n"); err != nil {
+			log.Error("Could not record served domains: ", err)
+		}
+	}
+
+	return batch
+}
+
+// Filter - keep only domains that were never seen, record and queue them.
+func (s *Store) Filter(incoming []string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	outgoing := make([]string, 0)
+
+	for _, host := range domain.NormalizeAll(incoming) {
+		if _, ok := s.seen[host]; ok {
+			continue
+		}
+
+		if _, err := s.out.WriteString(host + "\n"); err != nil {
+			return outgoing, err
+		}
+
+		s.seen[host] = struct{}{}
+		s.pending = append(s.pending, host)
+		outgoing = append(outgoing, host)
+	}
+
+	return outgoing, nil
+}
+
+// Result - append crawl result as JSON line.
+func (s *Store) Result(result *types.CrawlResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = s.results.Write(append(line, '\n'))
+
+	return err
+}
+
+func (s *Store) Close() error {
+	var result error
+
+	for _, f := range []*os.File{s.results, s.served, s.out} {
+		if err := f.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+}
+
+// NewStore - load seed and previously discovered domains, domains not handed out yet are queued again.
+// Handed out domains are recorded in servedFile, crawl results are appended to resultsFile.
+func NewStore(seedFile, outFile, servedFile, resultsFile string) (*Store, error) {
+	store := &Store{
+		pending: make([]string, 0),
+		seen:    make(map[string]struct{}),
+	}
+
+	served := make(map[string]struct{})
+	if err := readDomains(servedFile, func(host string) {
+		served[host] = struct{}{}
+	}); err != nil {
+		return nil, err
+	}
+
+	add := func(host string) {
+		if _, ok := store.seen[host]; ok {
+			return
+		}
+
+		store.seen[host] = struct{}{}
+
+		if _, ok := served[host]; !ok {
+			store.pending = append(store.pending, host)
+		}
+	}
+
+	if len(seedFile) > 0 {
+		if err := readDomains(seedFile, add); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := readDomains(outFile, add); err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		path string
+		file **os.File
+	}{
+		{outFile, &store.out},
+		{servedFile, &store.served},
+		{resultsFile, &store.results},
+	}
+
+	for i, f := range files {
+		file, err := openAppend(f.path)
+		if err != nil {
+			for _, opened := range files[:i] {
+				_ = (*opened.file).Close()
+			}
+
+			return nil, err
+		}
+
+		*f.file = file
+	}
+
+	return store, nil
+}
+
+type Server struct {
+	store     *Store
+	userAgent string
+	token     string
+	batchSize int
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(body)
+}
+
+// Auth - require X-Session-Token when token is configured.
+func (s *Server) Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.token) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Session-Token")), []byte(s.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, &types.JSONResponse{Code: http.StatusUnauthorized, Message: "invalid session token"})
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) UA(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &types.JSONResponse{Code: http.StatusOK, Message: s.userAgent})
+}
+
+func (s *Server) GetDomains(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &types.DomainsResponse{Domains: s.store.Next(s.batchSize)})
+}
+
+func (s *Server) Filter(w http.ResponseWriter, r *http.Request) {
+	var (
+		body           io.Reader = http.MaxBytesReader(w, r.Body, MaxBodySize)
+		domainsRequest types.DomainsResponse
+	)
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		defer gz.Close()
+
+		body = io.LimitReader(gz, MaxBodySize)
+	}
+
+	if err := json.NewDecoder(body).Decode(&domainsRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	outgoing, err := s.store.Filter(domainsRequest.Domains)
+	if err != nil {
+		log.Error("Filter error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &types.DomainsResponse{Domains: outgoing})
+}
+
+// Result - record crawl result of one domain.
+func (s *Server) Result(w http.ResponseWriter, r *http.Request) {
+	result := &types.CrawlResult{}
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodySize)).Decode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	host, err := domain.Normalize(result.Domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	result.Domain = host
+
+	if err = s.store.Result(result); err != nil {
+		log.Error("Result error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &types.JSONResponse{Code: http.StatusOK, Message: "OK"})
+}
+
+// Router - API contract documented in README under basePath, i.e. /api/vo.
+func (s *Server) Router(basePath string) *mux.Router {
+	r := mux.NewRouter()
+	api := r.PathPrefix(strings.TrimRight(basePath, "/")).Subrouter()
+	api.Use(s.Auth)
+	api.HandleFunc("/ua", s.UA).Methods(http.MethodGet)
+	api.HandleFunc("/domains", s.GetDomains).Methods(http.MethodGet)
+	api.HandleFunc("/filter", s.Filter).Methods(http.MethodPost)
+	api.HandleFunc("/result", s.Result).Methods(http.MethodPost)
+
+	return r
+}
+
+func NewServer(store *Store, userAgent, token string, batchSize int) *Server {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	return &Server{
+		store:     store,
+		userAgent: userAgent,
+		token:     token,
+		batchSize: batchSize,
+	}
+}
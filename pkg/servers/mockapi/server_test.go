@@ -0,0 +1,55 @@
+package mockapi
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoreRestart(t *testing.T) {
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "seed.txt")
+	out := filepath.Join(dir, "discovered.txt")
+	served := filepath.Join(dir, "served.txt")
+	results := filepath.Join(dir, "results.jsonl")
+
+	if err := os.WriteFile(seed, []byte("a.com\nb.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(seed, out, served, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := store.Next(1); !reflect.DeepEqual(got, []string{"a.com"}) {
+		t.Fatalf("Next() = %v", got)
+	}
+
+	if got, _ := store.Filter([]string{"a.com", "c.com", "d.com"}); !reflect.DeepEqual(got, []string{"c.com", "d.com"}) {
+		t.Fatalf("Filter() = %v", got)
+	}
+
+	if got := store.Next(2); !reflect.DeepEqual(got, []string{"b.com", "c.com"}) {
+		t.Fatalf("Next() = %v", got)
+	}
+
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewStore(seed, out, served, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if got := store.Next(10); !reflect.DeepEqual(got, []string{"d.com"}) {
+		t.Errorf("Next() after restart = %v, want [d.com]", got)
+	}
+
+	if got, _ := store.Filter([]string{"a.com", "d.com", "e.com"}); !reflect.DeepEqual(got, []string{"e.com"}) {
+		t.Errorf("Filter() after restart = %v, want [e.com]", got)
+	}
+}
@@ -3,12 +3,16 @@ package webserver
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/breaker"
+	"github.com/tb0hdan/idun/pkg/config"
 )
 
 type webServer struct {
@@ -23,7 +27,8 @@ type webServer struct {
 	build     string
 	buildDate string
 	//
-	router *mux.Router
+	router   *mux.Router
+	listener net.Listener
 }
 
 func (ws *webServer) Health(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +37,20 @@ func (ws *webServer) Health(w http.ResponseWriter, r *http.Request) {
 		ws.goVersion, ws.build,
 		ws.buildDate,
 	)
+	// API endpoints this process talked to
+	for _, status := range breaker.Default.Statuses() {
+		data += fmt.Sprintf("API endpoint: %s, state: %s, failures: %d", status.Name, status.State, status.Failures)
+
+		if !status.RetryAt.IsZero() {
+			data += fmt.Sprintf(", retry at: %s", status.RetryAt.Format(time.RFC3339))
+		}
+
+		if len(status.LastError) > 0 {
+			data += fmt.Sprintf(", last error: %s", status.LastError)
+		}
+
+		data += "\n"
+	}
 
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte(data))
@@ -44,26 +63,57 @@ func (ws *webServer) SetBuildInfo(version, goVersion, build, buildDate string) {
 	ws.buildDate = buildDate
 }
 
+// Handle - serve handler for every path under prefix.
+func (ws *webServer) Handle(prefix string, handler http.Handler) {
+	ws.router.PathPrefix(prefix).Handler(handler)
+}
+
+// Listen - bind address before Run so actual port is known, i.e. for random port and Consul registration.
+func (ws *webServer) Listen() error {
+	listener, err := net.Listen("tcp", ws.address)
+	if err != nil {
+		return err
+	}
+
+	ws.listener = listener
+
+	return nil
+}
+
+// Port - port web server listens on, 0 before Listen.
+func (ws *webServer) Port() int {
+	if ws.listener == nil {
+		return 0
+	}
+
+	return ws.listener.Addr().(*net.TCPAddr).Port
+}
+
 func (ws *webServer) Run() {
+	if ws.listener == nil {
+		if err := ws.Listen(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	srv := http.Server{
-		Addr:         ws.address,
 		Handler:      ws.router,
 		ReadTimeout:  ws.readTimeout,
 		WriteTimeout: ws.writeTimeout,
 		IdleTimeout:  ws.idleTimeout,
 	}
 
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if err := srv.Serve(ws.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
 }
 
-func NewWebServer(address string, readTimeout, writeTimeout, idleTimeout time.Duration) *webServer {
+func NewWebServer(address string, cfg *config.Config) *webServer {
 	ws := &webServer{
 		address:      address,
-		readTimeout:  readTimeout,
-		writeTimeout: writeTimeout,
-		idleTimeout:  idleTimeout,
+		readTimeout:  cfg.ReadTimeout,
+		writeTimeout: cfg.WriteTimeout,
+		idleTimeout:  cfg.IdleTimeout,
 	}
 	r := mux.NewRouter()
 	r.HandleFunc("/", ws.Health)
@@ -0,0 +1,208 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tb0hdan/idun/pkg/metrics"
+	"github.com/tb0hdan/idun/pkg/types"
+)
+
+const (
+	DirName    = "spool"
+	FileSuffix = ".jsonl"
+	// PollInterval - how often flusher looks for new batches when idle.
+	PollInterval = 30 * time.Second
+	MaxBackoff   = 10 * time.Minute
+	// Jitter - fraction of backoff randomized to spread workers apart.
+	Jitter = 0.2
+)
+
+var ErrSpoolFull = errors.New("spool is full") // nolint:gochecknoglobals
+
+// Spool - unsent filter batches. Every batch is written once to its own file and removed after replay,
+// so crawler subprocesses and leader can use the same directory without locking.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	logger   *log.Logger
+}
+
+// files - pending batches, oldest first, and their total size.
+func (s *Spool) files() ([]string, int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, 0, len(entries))
+
+	var total int64
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), FileSuffix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		total += info.Size()
+
+		names = append(names, filepath.Join(s.dir, entry.Name()))
+	}
+	// names start with zero padded timestamp
+	sort.Strings(names)
+
+	return names, total, nil
+}
+
+func (s *Spool) updateMetrics() {
+	names, total, err := s.files()
+	if err != nil {
+		return
+	}
+
+	metrics.SpoolBatches.Set(float64(len(names)))
+	metrics.SpoolBytes.Set(float64(total))
+}
+
+// Append - record batch for later replay.
+func (s *Spool) Append(domains []string) error {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(&types.DomainsResponse{Domains: domains})
+	if err != nil {
+		return err
+	}
+
+	_, total, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	if s.maxBytes > 0 && total+int64(len(data)) > s.maxBytes {
+		metrics.SpoolDropped.Add(float64(len(domains)))
+
+		return fmt.Errorf("%w: %d bytes used", ErrSpoolFull, total)
+	}
+
+	name := fmt.Sprintf("%020d-%d%s", time.Now().UnixNano(), os.Getpid(), FileSuffix)
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+
+	if err = os.WriteFile(tmpPath, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	// rename is atomic, flusher never sees partial batch
+	if err = os.Rename(tmpPath, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+
+	metrics.SpoolWritten.Add(float64(len(domains)))
+
+	return nil
+}
+
+func (s *Spool) read(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &types.DomainsResponse{}
+	if err = json.Unmarshal(data, batch); err != nil {
+		return nil, err
+	}
+
+	return batch.Domains, nil
+}
+
+// flushAll - replay batches until first failure.
+func (s *Spool) flushAll(flush func(domains []string) error) error {
+	names, _, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		domains, err := s.read(name)
+		if err != nil {
+			// corrupted batch, nothing to retry
+			s.logger.Errorf("Dropping spooled batch %s: %+v", name, err)
+			_ = os.Remove(name)
+
+			continue
+		}
+
+		if err = flush(domains); err != nil {
+			return err
+		}
+
+		if err = os.Remove(name); err != nil {
+			return err
+		}
+
+		metrics.SpoolReplayed.Add(float64(len(domains)))
+	}
+
+	return nil
+}
+
+func withJitter(delay time.Duration) time.Duration {
+	spread := float64(delay) * Jitter
+
+	return delay + time.Duration(spread*(2*rand.Float64()-1)) // nolint:gosec
+}
+
+// Run - replay spooled batches with exponential backoff until context is cancelled.
+func (s *Spool) Run(ctx context.Context, initialBackoff time.Duration, flush func(domains []string) error) {
+	backoff := initialBackoff
+
+	for {
+		delay := PollInterval
+
+		if err := s.flushAll(flush); err != nil {
+			s.logger.Errorf("Spool replay failed, retrying in %s: %+v", backoff, err)
+			delay = backoff
+
+			backoff *= 2
+			if backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+		} else {
+			backoff = initialBackoff
+		}
+
+		s.updateMetrics()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(withJitter(delay)):
+		}
+	}
+}
+
+// New - spool in dataDir/spool. MaxBytes of 0 means unlimited.
+func New(dataDir string, maxBytes int64, logger *log.Logger) (*Spool, error) {
+	dir := filepath.Join(dataDir, DirName)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &Spool{dir: dir, maxBytes: maxBytes, logger: logger}, nil
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"net/http"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -10,6 +11,7 @@ type APIClientInterface interface {
 	GetUA(uaURL string) (string, error)
 	GetDomains() ([]string, error)
 	FilterDomains(incoming []string) (outgoing []string, err error)
+	ReportResult(result *CrawlResult) error
 	Fatal(args ...interface{})
 	Debugf(format string, args ...interface{})
 	GetLogger() *log.Logger
@@ -17,6 +19,7 @@ type APIClientInterface interface {
 
 type WorkerCalculator interface {
 	CalculateMaxWorkers() (int64, error)
+	MemoryBudget() (uint64, error)
 }
 
 type APIServerInterface interface {
@@ -25,3 +28,26 @@ type APIServerInterface interface {
 	Pop() string
 	GetUA() string
 }
+
+type QueueInterface interface {
+	Push(domain string, priority int) error
+	PushAfter(domain string, priority int, delay time.Duration) error
+	Pop() (string, error)
+	Len() int
+	Close() error
+}
+
+// RegistryInterface - recently crawled domains shared between workers.
+type RegistryInterface interface {
+	// Claim - true when domain wasn't claimed by anyone within window, claim is recorded.
+	Claim(domain string, window time.Duration) (bool, error)
+}
+
+// LimiterInterface - per-IP/subnet request rate limiter.
+type LimiterInterface interface {
+	// Reserve - take token for request to ip. When not allowed, nothing is taken and wait
+	// until token is available is returned.
+	Reserve(ip string) (wait time.Duration, allowed bool, err error)
+	// Check - same as Reserve, but token is never taken.
+	Check(ip string) (wait time.Duration, allowed bool, err error)
+}
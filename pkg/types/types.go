@@ -15,7 +15,7 @@ const (
 	MaxDomainsInMap = 1024
 	TickEvery       = 10 * time.Second
 	Parallelism     = 2
-	RandomDelay     = 60 * time.Second
+	RandomDelay     = 1 * time.Second
 	APIRetryMax     = 3
 	//
 	ReadTimeout  = 30 * time.Second
@@ -26,10 +26,21 @@ const (
 	// process control.
 	CrawlerExtra     = 10 * time.Second
 	KillSleep        = 3 * time.Second
+	ShutdownGrace    = 30 * time.Second
 	CrawlFilterRetry = 60 * time.Second
+	SpoolMaxBytes    = 64 * OneMeg
+	RegistryWindow   = 24 * time.Hour
 	HeadCheckTimeout = 10 * time.Second
+	// CrawlerRequestTimeout - crawler page request, retries and body included.
+	CrawlerRequestTimeout = 2 * time.Minute
 	// process limits.
 	CrawlerMaxRunTime = 600 * time.Second
+	// crawler subprocess rlimits and cgroup, address space of Go program is much larger than RSS.
+	ChildAddressSpaceReserve = 4 * OneGig
+	ChildMaxFiles            = 4096
+	ChildMaxPids             = 512
+	// ExitCodeCPULimit - crawler subprocess exit code after SIGXCPU.
+	ExitCodeCPULimit = 3
 )
 
 var (
@@ -41,6 +52,26 @@ type DomainsResponse struct {
 	Domains []string `json:"domains"`
 }
 
+// CrawlResult - /result request body, summary of one crawled domain.
+type CrawlResult struct {
+	Domain string `json:"domain"`
+	// FinalURL - seed URL after redirects
+	FinalURL string `json:"final_url"`
+	// Status - HTTP status of FinalURL, 0 when there was no response
+	Status int    `json:"status"`
+	Server string `json:"server"`
+	Pages  int    `json:"pages"`
+	// Discovered - hosts found during crawl, before filtering
+	Discovered int `json:"discovered"`
+	// TLSVersion, TLSIssuer - empty for plain HTTP
+	TLSVersion string `json:"tls_version"`
+	TLSIssuer  string `json:"tls_issuer"`
+	// Reason - why crawl stopped: normal, timeout, oom_kill, memory_limit, cpu_limit or error
+	Reason string `json:"reason"`
+	// Duration - seconds
+	Duration float64 `json:"duration"`
+}
+
 type JSONResponse struct {
 	Code    int64  `json:"code"`
 	Message string `json:"message"`
@@ -1,10 +1,14 @@
 package utils
 
 import (
+	"math"
 	"runtime"
 
 	sigar "github.com/cloudfoundry/gosigar"
+	log "github.com/sirupsen/logrus"
 
+	"github.com/tb0hdan/idun/pkg/cgroup"
+	"github.com/tb0hdan/idun/pkg/config"
 	"github.com/tb0hdan/idun/pkg/types"
 )
 
@@ -13,34 +17,105 @@ const (
 	MaxPerGig  = 4
 )
 
+// Resources - CPUs and memory available to this process. Host values limited by cgroup, when there is one.
+type Resources struct {
+	CPUs        float64
+	MemoryTotal uint64
+	MemoryFree  uint64
+	// MemoryLimit - cgroup memory limit, 0 when not limited
+	MemoryLimit uint64
+}
+
+func GetResources() (Resources, error) {
+	mem := sigar.Mem{}
+	if err := mem.Get(); err != nil {
+		return Resources{}, err
+	}
+
+	res := Resources{
+		CPUs:        float64(runtime.NumCPU()),
+		MemoryTotal: mem.Total,
+		MemoryFree:  mem.ActualFree,
+	}
+
+	limits, err := cgroup.Read()
+	if err != nil {
+		// host values are still usable
+		log.Debugf("Could not read cgroup limits: %+v", err)
+
+		return res, nil
+	}
+
+	if limits.CPUs > 0 && limits.CPUs < res.CPUs {
+		res.CPUs = limits.CPUs
+	}
+
+	if limits.MemoryMax > 0 && limits.MemoryMax < res.MemoryTotal {
+		res.MemoryLimit = limits.MemoryMax
+		res.MemoryTotal = limits.MemoryMax
+
+		var free uint64
+		if limits.MemoryUsed < limits.MemoryMax {
+			free = limits.MemoryMax - limits.MemoryUsed
+		}
+
+		if free < res.MemoryFree {
+			res.MemoryFree = free
+		}
+	}
+
+	return res, nil
+}
+
+// MemoryPerWorker - crawler memory cap: configured limit, lowered to share of memory budget
+// when budget (i.e. container limit) is known.
+func MemoryPerWorker(limit, budget uint64, workers int64) uint64 {
+	if budget == 0 || workers < 1 {
+		return limit
+	}
+
+	if share := budget / uint64(workers); share < limit {
+		return share
+	}
+
+	return limit
+}
+
 type Calculator struct {
-	OvercommitRatio int64
+	Config *config.Config
 }
 
 func (c *Calculator) CalculateMaxWorkers() (int64, error) {
-	maxAllowed := int64(1)
-	mem := sigar.Mem{}
-	err := mem.Get()
+	res, err := GetResources()
 	if err != nil {
 		return 0, err
 	}
 
-	cpus := runtime.NumCPU()
-	cpuMax := int64(cpus * MaxPerCore)
-	gigs := mem.ActualFree / types.OneGig
-	memMax := int64(gigs * MaxPerGig)
+	cpuMax := int64(math.Ceil(res.CPUs * MaxPerCore))
+	memMax := int64(res.MemoryFree * MaxPerGig / types.OneGig)
 
-	if cpuMax > memMax || cpuMax == memMax {
+	maxAllowed := cpuMax
+	if memMax < cpuMax {
 		maxAllowed = memMax
 	}
-
-	if memMax > cpuMax {
-		maxAllowed = cpuMax
+	// small boxes still run one worker
+	if maxAllowed < 1 {
+		maxAllowed = 1
 	}
 
-	if c.OvercommitRatio > 1 {
-		maxAllowed = maxAllowed * c.OvercommitRatio
+	if c.Config.OvercommitRatio > 1 {
+		maxAllowed = maxAllowed * c.Config.OvercommitRatio
 	}
 
 	return maxAllowed, nil
 }
+
+// MemoryBudget - memory shared by crawlers, cgroup limit or 0 when not limited.
+func (c *Calculator) MemoryBudget() (uint64, error) {
+	res, err := GetResources()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.MemoryLimit, nil
+}
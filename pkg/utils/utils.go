@@ -6,13 +6,11 @@ import (
 	"net/http"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
-	sigar "github.com/cloudfoundry/gosigar"
-	log "github.com/sirupsen/logrus"
-
-	"github.com/tb0hdan/idun/pkg/types"
+	"github.com/tb0hdan/idun/pkg/domain"
+	"github.com/tb0hdan/idun/pkg/ippolicy"
+	"github.com/tb0hdan/idun/pkg/metrics"
 )
 
 func DeduplicateSlice(incoming []string) (outgoing []string) {
@@ -30,65 +28,17 @@ func DeduplicateSlice(incoming []string) (outgoing []string) {
 	return
 }
 
-func KillPid(pid int) {
-	_ = syscall.Kill(pid, syscall.SIGTERM)
-	//
-	time.Sleep(types.KillSleep)
-	//
-	_ = syscall.Kill(pid, syscall.SIGKILL)
-}
-
-func WaitAndKill(sleepTime time.Duration, pid int) {
-	time.Sleep(sleepTime)
-	log.Println("Run time exceeded, sending signal to ", pid)
-	KillPid(pid)
-}
-
-func PIDWatcher(pid int) {
-	ticker := time.NewTicker(types.TickEvery)
-	for t := range ticker.C {
-		pm := sigar.ProcMem{}
-		err := pm.Get(pid)
-		//
-		if err != nil && err.Error() != "no such process" {
-			log.Error("PIDWatcher ", err)
-
-			break
-		}
-
-		if err != nil {
-			// process doesn't exit
-			break
-		}
-
-		log.Debugf("Parent tick for %d at %s: %v\n", pid, t, pm.Resident/types.OneGig)
-
-		if pm.Resident > types.TwoGigs {
-			log.Debugf("Killing subprocess, memory used %d Kb > %d Kb memory allowed\n", pm.Resident/types.OneK, types.TwoGigs/types.OneK)
-			KillPid(pid)
-
-			break
-		}
-	}
-
-	ticker.Stop()
-}
-
-func HeadCheck(domain string, ua string) bool {
-	tr := &http.Transport{
-		DisableKeepAlives: true,
-	}
+func HeadCheck(host string, ua string, timeout time.Duration) bool {
+	tr := ippolicy.Default.Transport()
+	tr.DisableKeepAlives = true
 	client := &http.Client{
 		Transport: tr,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), types.HeadCheckTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 
 	defer cancel()
 
-	target := domain
-	if !strings.HasPrefix(domain, "http://") && !strings.HasPrefix(domain, "https://") {
-		target = fmt.Sprintf("http://%s", domain)
-	}
+	target := domain.ToURL(host)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
 	//
@@ -111,7 +61,7 @@ func HeadCheck(domain string, ua string) bool {
 	return true
 }
 
-func HeadCheckDomains(domains []string, ua string) map[string]struct{} {
+func HeadCheckDomains(domains []string, ua string, timeout time.Duration) map[string]struct{} {
 	results := make(map[string]struct{})
 	wg := &sync.WaitGroup{}
 	lock := &sync.RWMutex{}
@@ -120,11 +70,14 @@ func HeadCheckDomains(domains []string, ua string) map[string]struct{} {
 		wg.Add(1)
 
 		go func(domain string, wg *sync.WaitGroup) {
-			result := HeadCheck(domain, ua)
+			result := HeadCheck(domain, ua, timeout)
 			if result {
 				lock.Lock()
 				results[domain] = struct{}{}
 				lock.Unlock()
+				metrics.HeadChecks.WithLabelValues(metrics.ResultPass).Inc()
+			} else {
+				metrics.HeadChecks.WithLabelValues(metrics.ResultFail).Inc()
 			}
 			wg.Done()
 		}(domain, wg)